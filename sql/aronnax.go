@@ -3,12 +3,16 @@ package main
 import (
 	query "./lang"
 	"bufio"
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/satori/go.uuid"
 	"log"
 	"os"
+	"os/signal"
+	"sync"
 	"time"
 )
 
@@ -16,47 +20,55 @@ var ZERO_TIME = time.Time{}
 
 type mysqlBackend struct {
 	db *sql.DB
+	// maximum time a query may run; 0 means no limit
+	timeout time.Duration
+	// a document is checkpointed once it has this many edits since its last
+	// checkpoint, or its edits span this long; 0 disables either rule
+	checkpointEdits    int
+	checkpointInterval time.Duration
 }
 
-var tableCreate = `
-CREATE TABLE data
-(
-    uuid CHAR(37) NOT NULL,
-    dkey VARCHAR(128) NOT NULL,
-    dval VARCHAR(128) NULL,
-    timestamp TIMESTAMP(6) NOT NULL
-);
-`
-
 var whereTemplate = `
 select second.uuid, second.dkey, second.dval, second.timestamp
 from (
-   select data.uuid, data.dkey, data.dval, data.timestamp
-   from data
-   inner join
-   (
-        select distinct uuid, dkey, max(timestamp) as maxtime from data group by dkey, uuid order by timestamp desc
-   ) sorted
-   on data.uuid = sorted.uuid and data.dkey = sorted.dkey and data.timestamp = sorted.maxtime
-   where data.dval is not null
+   select uuid, dkey, dval, timestamp
+   from current
+   where dval is not null
 ) as second
 right join
 (
     %s
 ) internal
-on internal.uuid = second.uuid;
+on internal.uuid = second.uuid
+order by second.uuid;
+`
+
+var historyTemplate = `
+select dkey, dval, timestamp from data
+where uuid = ? and timestamp < ?
+order by timestamp asc;
 `
 
+// upper bound on timestamps for queries with an open-ended time range
+var MAX_TIME = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+
 var showQuery = flag.Bool("debug", false, "Show generated MySQL queries")
 var httpPort = flag.Int("port", 2000, "Serve query interface on HTTP port")
+var queryTimeout = flag.Duration("timeout", time.Minute, "Maximum time a query may run (0 for no limit)")
+var checkpointEdits = flag.Int("checkpoint-edits", 100, "Checkpoint a document after this many edits (0 to disable)")
+var checkpointInterval = flag.Duration("checkpoint-interval", 24*time.Hour, "Checkpoint a document once its edits since the last checkpoint span this long (0 to disable)")
+var rebuildCurrentFlag = flag.Bool("rebuild-current", false, "Recompute the current state table from history on startup")
+var retentionFlag = flag.String("retention", "", "Retention policies by key prefix, such as \"Location/*=0,Status/*=90d\" (keys without a policy are kept forever)")
+var compactInterval = flag.Duration("compact-interval", 0, "Compact history this often (0, the default, disables compaction)")
 
 func newBackend(user, password, database string) *mysqlBackend {
 	var (
-		db     *sql.DB
-		err    error
-		tables *sql.Rows
+		db  *sql.DB
+		err error
 	)
-	if db, err = sql.Open("mysql", fmt.Sprintf("%s:%s@/%s?parseTime=true", user, password, database)); err != nil {
+	// sessions use UTC, the time zone the driver reads times in, so that the
+	// datetime literals we write mean what we read back
+	if db, err = sql.Open("mysql", fmt.Sprintf("%s:%s@/%s?parseTime=true&time_zone=%%27%%2B00%%3A00%%27", user, password, database)); err != nil {
 		log.Fatal(err)
 	}
 
@@ -65,102 +77,358 @@ func newBackend(user, password, database string) *mysqlBackend {
 		log.Fatal(err)
 	}
 
-	// check if table is created
-	if tables, err = db.Query("show tables;"); err != nil {
+	// create the tables, or upgrade them to the current schema
+	if _, err = migrate(context.Background(), db); err != nil {
 		log.Fatal(err)
 	}
 
-	foundTable := false
-	for tables.Next() && !foundTable {
-		var name string
-		if err := tables.Scan(&name); err != nil {
-			log.Fatal(err)
-		}
-		foundTable = (name == "data")
+	return &mysqlBackend{
+		db: db,
 	}
+}
 
-	// if table not found, create it!
-	if !foundTable {
-		if _, err = db.Exec(tableCreate); err != nil {
-			log.Fatal(err)
+// remove data from table
+func (mbd *mysqlBackend) RemoveData() error {
+	return mbd.inTx(context.Background(), func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM data;"); err != nil {
+			return err
 		}
+		if _, err := tx.Exec("DELETE FROM current;"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM checkpoints;")
+		return err
+	})
+}
+
+// Inserts the document's tags at the database's current time. Unless force
+// is true, tags that would not change the value of their key are skipped.
+// Returns the sorted keys whose values changed
+func (mbd *mysqlBackend) Insert(doc *Document, force bool) ([]string, error) {
+	return mbd.InsertWithTimestamp(doc, ZERO_TIME, force)
+}
+
+// Inserts the document's tags at the given time, or at the database's current
+// time if it is zero (see Insert)
+func (mbd *mysqlBackend) InsertWithTimestamp(doc *Document, timestamp time.Time, force bool) ([]string, error) {
+	if len(doc.Tags) == 0 {
+		return nil, nil
+	}
+	batch, err := mbd.Begin(context.Background())
+	if err != nil {
+		return nil, err
 	}
+	if err = batch.InsertWithTimestamp(doc, timestamp, force); err != nil {
+		return nil, err
+	}
+	if err = batch.Commit(); err != nil {
+		return nil, err
+	}
+	return batch.Changed()[doc.UUID.String()], nil
+}
 
-	return &mysqlBackend{
-		db: db,
+// Inserts the document's tags as facts that hold from timestamp (or the
+// database's current time if it is zero) until, but not including, until,
+// after which each key reverts (see Batch.InsertInterval)
+func (mbd *mysqlBackend) InsertInterval(doc *Document, timestamp, until time.Time, force bool) ([]string, error) {
+	if len(doc.Tags) == 0 {
+		return nil, nil
+	}
+	batch, err := mbd.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if err = batch.InsertInterval(doc, timestamp, until, force); err != nil {
+		return nil, err
+	}
+	if err = batch.Commit(); err != nil {
+		return nil, err
 	}
+	return batch.Changed()[doc.UUID.String()], nil
 }
 
-// remove data from table
-func (mbd *mysqlBackend) RemoveData() error {
-	_, err := mbd.db.Exec("DELETE FROM data;")
-	return err
+// Returns the most recent version of the document with the given UUID. If the
+// document has no keys, the returned document has an empty set of tags
+func (mbd *mysqlBackend) CurrentDocument(ctx context.Context, uid uuid.UUID) (*Document, error) {
+	return mbd.DocumentAt(ctx, uid, ZERO_TIME)
 }
 
-func (mbd *mysqlBackend) Insert(doc *Document) error {
-	_, err := mbd.db.Exec(doc.GenerateInsertStatement(true))
-	return err
+// Reconstructs the document with the given UUID as it was at the given time
+// (inclusive). A zero time returns the most recent version of the document
+func (mbd *mysqlBackend) DocumentAt(ctx context.Context, uid uuid.UUID, at time.Time) (*Document, error) {
+	if at != ZERO_TIME {
+		return mbd.documentAt(ctx, mbd.db, uid, at, true)
+	}
+	rows, err := mbd.db.QueryContext(ctx, currentDocumentTemplate, uid.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	docs, err := DocsFromRows(rows, at)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return &Document{UUID: uid, Tags: map[string]string{}, TagTimes: map[string]time.Time{}, ValidTime: at}, nil
+	}
+	return docs[0], nil
 }
 
-func (mbd *mysqlBackend) InsertWithTimestamp(doc *Document, timestamp time.Time) error {
-	_, err := mbd.db.Exec(doc.GenerateInsertStatementWithTimestamp(timestamp))
-	return err
+// Returns the ordered list of edits made to the document with the given UUID
+// in [start, end). A zero start or end leaves that side of the range open. It
+// is cancelled when ctx is done or the query timeout passes
+func (mbd *mysqlBackend) History(ctx context.Context, uid uuid.UUID, start, end time.Time) ([]*Edit, error) {
+	ctx, cancel := mbd.withTimeout(ctx)
+	defer cancel()
+	if end == ZERO_TIME {
+		end = MAX_TIME
+	}
+	rows, err := mbd.db.QueryContext(ctx, historyTemplate, uid.String(), end)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+	edits, err := HistoryFromRows(rows, start)
+	return edits, contextError(ctx, err)
 }
 
-// passes through the error if it is nil
-func (mbd *mysqlBackend) Eval(q *query.Query) ([]*Document, error) {
+// Returns a context that is done when ctx is or when the query timeout
+// passes, if there is one
+func (mbd *mysqlBackend) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if mbd.timeout > 0 {
+		return context.WithTimeout(ctx, mbd.timeout)
+	}
+	return ctx, func() {}
+}
+
+// the subset of *sql.DB, *sql.Conn and *sql.Tx used to evaluate statements,
+// so that a batch of statements can be evaluated inside a transaction
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// The result of evaluating a single statement of a batch
+type Result struct {
+	Documents []*Document       `json:"documents"`
+	Error     *query.QueryError `json:"error,omitempty"`
+	// set instead of Documents for EXPLAIN statements
+	Explain *Explanation `json:"explain,omitempty"`
+	// set instead of Documents for statements that select a diff
+	Diffs []*DocumentDiff `json:"diffs,omitempty"`
+	// set instead of Documents for statements that select a traversal
+	Traversals []*TraversalResult `json:"traversals,omitempty"`
+	// set instead of Documents for statements that define an event
+	Event *query.Event `json:"event,omitempty"`
+	// set instead of Documents for "set timezone" statements
+	Timezone string `json:"timezone,omitempty"`
+	// the version of the snapshot the statement was evaluated on, for
+	// statements evaluated in a transaction
+	Version *time.Time `json:"version,omitempty"`
+}
+
+// Evaluates the query, which is cancelled when ctx is done or the query
+// timeout passes. Cancelled queries return a *query.QueryError
+func (mbd *mysqlBackend) Eval(ctx context.Context, q *query.Query) ([]*Document, error) {
+	return mbd.eval(ctx, mbd.db, q)
+}
+
+// Evaluates the statements in order. If transactional is true, the statements
+// are evaluated on a single snapshot of the database (see Snapshot), so they
+// see the same state of the database, and each Result carries the version of
+// that snapshot: evaluation stops at the first error, which is returned.
+// Since the snapshot is read-only, such batches cannot define events.
+// Otherwise each statement is evaluated on its own and errors are reported in
+// its Result
+func (mbd *mysqlBackend) EvalBatch(ctx context.Context, queries []*query.Query, transactional bool) ([]*Result, error) {
+	var (
+		results = make([]*Result, 0, len(queries))
+		db      queryer
+		version *time.Time
+	)
+	if transactional {
+		for _, q := range queries {
+			if q.Define != nil {
+				return nil, &query.QueryError{Kind: query.ParseError, Message: fmt.Sprintf("define event %s cannot be evaluated in a transaction, which is read-only", q.Define.Name)}
+			}
+		}
+		snapshot, err := mbd.Snapshot(ctx)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+		defer snapshot.Close()
+		db = snapshot.tx
+		version = &snapshot.Version
+	} else {
+		db = mbd.db
+	}
+	for _, q := range queries {
+		if q.Timezone != nil {
+			results = append(results, &Result{Timezone: q.Timezone.String(), Version: version})
+			continue
+		}
+		if q.Define != nil {
+			if defineErr := mbd.DefineEvent(ctx, *q.Define); defineErr != nil {
+				results = append(results, &Result{Error: query.AsQueryError(query.EvalError, defineErr)})
+			} else {
+				results = append(results, &Result{Event: q.Define})
+			}
+			continue
+		}
+		if q.Explain {
+			explanation, explainErr := mbd.explain(ctx, db, q)
+			if explainErr != nil && transactional {
+				return nil, explainErr
+			} else if explainErr != nil {
+				results = append(results, &Result{Error: query.AsQueryError(query.EvalError, explainErr)})
+			} else {
+				results = append(results, &Result{Explain: explanation, Version: version})
+			}
+			continue
+		}
+		if _, isDiff := q.Diff(); isDiff {
+			diffs, diffErr := mbd.evalDiff(ctx, db, q)
+			if diffErr != nil && transactional {
+				return nil, diffErr
+			} else if diffErr != nil {
+				results = append(results, &Result{Error: query.AsQueryError(query.EvalError, diffErr)})
+			} else {
+				results = append(results, &Result{Diffs: diffs, Version: version})
+			}
+			continue
+		}
+		if q.Traversal != nil {
+			traversals, traversalErr := mbd.evalTraversal(ctx, db, q)
+			if traversalErr != nil && transactional {
+				return nil, traversalErr
+			} else if traversalErr != nil {
+				results = append(results, &Result{Error: query.AsQueryError(query.EvalError, traversalErr)})
+			} else {
+				results = append(results, &Result{Traversals: traversals, Version: version})
+			}
+			continue
+		}
+		docs, evalErr := mbd.eval(ctx, db, q)
+		if evalErr != nil && transactional {
+			return nil, evalErr
+		} else if evalErr != nil {
+			results = append(results, &Result{Error: query.AsQueryError(query.EvalError, evalErr)})
+		} else {
+			results = append(results, &Result{Documents: docs, Version: version})
+		}
+	}
+	return results, nil
+}
+
+func (mbd *mysqlBackend) eval(ctx context.Context, db queryer, q *query.Query) ([]*Document, error) {
+	var docs = []*Document{}
+	iter, err := mbd.stream(ctx, db, q)
+	if err != nil {
+		return docs, err
+	}
+	defer iter.Close()
+	for iter.Next() {
+		docs = append(docs, iter.Document())
+	}
+	return docs, iter.Err()
+}
+
+// Evaluates the query, returning an iterator that yields each matching
+// document as soon as it has been read from the database. The iterator must be
+// closed
+func (mbd *mysqlBackend) EvalStream(ctx context.Context, q *query.Query) (*DocIterator, error) {
+	return mbd.stream(ctx, mbd.db, q)
+}
+
+func (mbd *mysqlBackend) stream(ctx context.Context, db queryer, q *query.Query) (*DocIterator, error) {
 	var (
-		docs    = []*Document{}
-		err     error
 		evalErr error
 		rows    *sql.Rows
+		release func()
 		tosend  string
 	)
+	ctx, cancel := mbd.withTimeout(ctx)
 	// build SQL string using WHERE clause
-	if q.Wheres.SQL != "" {
-		tosend = fmt.Sprintf(whereTemplate, q.Wheres.SQL)
-	}
+	tosend = querySQL(q)
 	// print generated query if flag is set
 	if *showQuery {
 		fmt.Println(tosend)
 	}
+	changes, evalErr := transitions(ctx, db, q)
+	if evalErr != nil {
+		cancel()
+		return nil, contextError(ctx, evalErr)
+	}
+	spans, evalErr := durations(ctx, db, q)
+	if evalErr != nil {
+		cancel()
+		return nil, contextError(ctx, evalErr)
+	}
 	// evaluate WHERE clause against the backend
-	if rows, evalErr = mbd.db.Query(tosend); evalErr != nil {
-		return docs, evalErr
+	if rows, release, evalErr = mbd.queryKillable(ctx, db, tosend); evalErr != nil {
+		cancel()
+		return nil, evalErr
 	}
 
-	// transform the returned rows into documents so they are easier to work with
-	if docs, err = DocsFromRows(rows, q.Now); err != nil {
-		return docs, err
+	// transform the returned rows into documents so they are easier to work
+	// with. For each document, the select clause pulls out which keys match
+	iter := NewDocIterator(rows, q.Now)
+	iter.selects = q.Selects
+	iter.transitions = changes
+	iter.durations = spans
+	iter.ctx = ctx
+	iter.release = func() {
+		release()
+		cancel()
 	}
+	return iter, nil
+}
 
-	// apply the select clause
-	for idx, doc := range docs {
-		// for each document, for each term in the select clause, pull out
-		// which keys in the document match
-		fmt.Println(idx, doc)
-		doc.ApplySelect(q.Selects)
+// Returns the SQL sent to the backend for the query's WHERE clause
+func querySQL(q *query.Query) string {
+	if q.Wheres.SQL == "" {
+		return ""
 	}
-	fmt.Println(q.Selects)
-	return docs, err
+	return fmt.Sprintf(whereTemplate, q.Wheres.SQL)
 }
 
+// Parses a single statement. Errors are returned as a *query.QueryError
 func (mbd *mysqlBackend) Parse(querystring string) (*query.Query, error) {
-	var parseErr error
-	lex := query.NewQueryLexer(querystring)
+	lex, err := mbd.newLexer(querystring, time.UTC)
+	if err != nil {
+		return nil, err
+	}
 	query.QueryParse(lex)
 	if lex.Err != nil {
-		parseErr = fmt.Errorf("ERROR %s %s", lex.Err, querystring)
+		return lex.Query, lex.Err
+	}
+	if len(lex.Queries) != 1 {
+		return lex.Query, &query.QueryError{Kind: query.ParseError, Message: fmt.Sprintf("expected a single statement but found %d", len(lex.Queries))}
 	}
-	return lex.Query, parseErr
+	return lex.Queries[0], nil
+}
+
+// Parses one or more statements, each terminated by a semicolon. Errors are
+// returned as a *query.QueryError
+func (mbd *mysqlBackend) ParseAll(querystring string) ([]*query.Query, error) {
+	return mbd.parseAllIn(querystring, time.UTC)
+}
+
+// Parses the statements with times read in the given time zone until a "set
+// timezone" statement changes it
+func (mbd *mysqlBackend) parseAllIn(querystring string, loc *time.Location) ([]*query.Query, error) {
+	lex, err := mbd.newLexer(querystring, loc)
+	if err != nil {
+		return nil, err
+	}
+	query.QueryParse(lex)
+	return lex.Queries, lex.Err
 }
 
 // passes through the error if it is nil
 func (mbd *mysqlBackend) EvalWhere(q *query.Query, err error) (*sql.Rows, time.Time, error) {
-	var tosend string
-	if q.Wheres.SQL != "" {
-		tosend = fmt.Sprintf(whereTemplate, q.Wheres.SQL)
-	}
+	var tosend = querySQL(q)
 	if *showQuery {
 		fmt.Println(tosend)
 	}
@@ -172,36 +440,159 @@ func (mbd *mysqlBackend) EvalWhere(q *query.Query, err error) (*sql.Rows, time.T
 	}
 }
 
+// Reads and evaluates statements from stdin. Ctrl-C cancels the running
+// query, or exits if no query is running. A "set timezone" statement applies
+// to the rest of the session
 func (mbd *mysqlBackend) StartInteractive() {
-	fi := bufio.NewReader(os.Stdin)
+	var (
+		fi         = bufio.NewReader(os.Stdin)
+		interrupts = make(chan os.Signal, 1)
+		running    = &runningQuery{}
+		loc        = time.UTC
+	)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		for range interrupts {
+			if !running.cancel() {
+				os.Exit(130)
+			}
+		}
+	}()
 	for {
 		fmt.Printf("aronnax> ")
 		s, err := fi.ReadString('\n')
 		if err != nil {
 			log.Fatal(err)
 		}
-		parsed, parseErr := mbd.Parse(s)
+		parsed, parseErr := mbd.parseAllIn(s, loc)
 		if parseErr != nil {
-			log.Print("Error parse: ", parseErr)
+			log.Print(query.AsQueryError(query.ParseError, parseErr).Diagnostic())
 			continue
 		}
-		docs, evalErr := mbd.Eval(parsed)
-		if evalErr != nil {
-			log.Print("Error eval: ", evalErr)
-			continue
+		for _, q := range parsed {
+			if q.Timezone != nil {
+				loc = q.Timezone
+				fmt.Printf("Time zone set to %s\n", loc)
+				continue
+			}
+			ctx := running.start()
+			mbd.printResults(ctx, q)
+			running.stop()
 		}
-		for _, doc := range docs {
-			fmt.Println(doc.PrettyString())
+	}
+}
+
+func (mbd *mysqlBackend) printResults(ctx context.Context, q *query.Query) {
+	if q.Define != nil {
+		if err := mbd.DefineEvent(ctx, *q.Define); err != nil {
+			log.Print(query.AsQueryError(query.EvalError, err).Diagnostic())
+			return
+		}
+		fmt.Printf("Defined event %s in [%s, %s]\n", q.Define.Name, q.Define.Start.Format(time.RFC3339Nano), q.Define.End.Format(time.RFC3339Nano))
+		return
+	}
+	if q.Explain {
+		explanation, explainErr := mbd.Explain(ctx, q)
+		if explainErr != nil {
+			log.Print(query.AsQueryError(query.EvalError, explainErr).Diagnostic())
+			return
+		}
+		fmt.Print(explanation.String())
+		return
+	}
+	if _, isDiff := q.Diff(); isDiff {
+		diffs, diffErr := mbd.EvalDiff(ctx, q)
+		if diffErr != nil {
+			log.Print(query.AsQueryError(query.EvalError, diffErr).Diagnostic())
+			return
+		}
+		for _, diff := range diffs {
+			fmt.Println(diff.PrettyString())
 		}
+		return
+	}
+	if q.Traversal != nil {
+		traversals, traversalErr := mbd.EvalTraversal(ctx, q)
+		if traversalErr != nil {
+			log.Print(query.AsQueryError(query.EvalError, traversalErr).Diagnostic())
+			return
+		}
+		for _, traversal := range traversals {
+			fmt.Println(traversal.PrettyString())
+		}
+		return
+	}
+	iter, evalErr := mbd.EvalStream(ctx, q)
+	if evalErr != nil {
+		log.Print(query.AsQueryError(query.EvalError, evalErr).Diagnostic())
+		return
+	}
+	defer iter.Close()
+	for iter.Next() {
+		fmt.Println(iter.Document().PrettyString())
+	}
+	if evalErr = iter.Err(); evalErr != nil {
+		log.Print(query.AsQueryError(query.EvalError, evalErr).Diagnostic())
+	}
+}
+
+// The query currently running in the REPL, so that it can be cancelled from
+// the signal handler
+type runningQuery struct {
+	sync.Mutex
+	cancelFunc context.CancelFunc
+}
+
+func (rq *runningQuery) start() context.Context {
+	rq.Lock()
+	defer rq.Unlock()
+	var ctx context.Context
+	ctx, rq.cancelFunc = context.WithCancel(context.Background())
+	return ctx
+}
+
+func (rq *runningQuery) stop() {
+	rq.Lock()
+	defer rq.Unlock()
+	if rq.cancelFunc != nil {
+		rq.cancelFunc()
+		rq.cancelFunc = nil
 	}
 }
 
+// cancels the running query. Returns false if no query is running
+func (rq *runningQuery) cancel() bool {
+	rq.Lock()
+	defer rq.Unlock()
+	if rq.cancelFunc == nil {
+		return false
+	}
+	rq.cancelFunc()
+	rq.cancelFunc = nil
+	return true
+}
+
 func main() {
 	flag.Parse()
 	user := os.Getenv("ARONNAXUSER")
 	pass := os.Getenv("ARONNAXPASS")
 	dbname := os.Getenv("ARONNAXDB")
 	backend := newBackend(user, pass, dbname)
+	backend.timeout = *queryTimeout
+	backend.checkpointEdits = *checkpointEdits
+	backend.checkpointInterval = *checkpointInterval
+	if *rebuildCurrentFlag {
+		if err := backend.RebuildCurrent(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}
+	policies, err := parseRetention(*retentionFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *compactInterval > 0 {
+		go backend.StartCompactor(policies, *compactInterval)
+	}
 
 	// setup HTTP server
 	go backend.StartInteractive()
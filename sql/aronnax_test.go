@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"github.com/satori/go.uuid"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEvalBatch(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+
+	queries, err := backend.ParseAll(`select * where Location/Room = '410'; select * where Location/Room = '405';`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	for _, transactional := range []bool{false, true} {
+		results, err := backend.EvalBatch(context.Background(), queries, transactional)
+		if err != nil {
+			t.Errorf("EvalBatch (transactional: %v) failed: %v", transactional, err)
+			continue
+		}
+		if len(results) != 2 {
+			t.Errorf("EvalBatch (transactional: %v): expected 2 results but got %d", transactional, len(results))
+			continue
+		}
+		if len(results[0].Documents) != 2 || len(results[1].Documents) != 1 {
+			t.Errorf("EvalBatch (transactional: %v): expected 2 and 1 documents but got %d and %d", transactional, len(results[0].Documents), len(results[1].Documents))
+		}
+	}
+}
+
+func TestEvalStream(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+
+	q, err := backend.Parse(`select * where has Location/Room;`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	iter, err := backend.EvalStream(context.Background(), q)
+	if err != nil {
+		t.Fatalf("EvalStream failed: %v", err)
+	}
+	defer iter.Close()
+	var (
+		seen = map[uuid.UUID]bool{}
+		last string
+	)
+	for iter.Next() {
+		doc := iter.Document()
+		if seen[doc.UUID] {
+			t.Errorf("Document %v yielded more than once", doc.UUID)
+		}
+		if doc.UUID.String() < last {
+			t.Errorf("Document %v yielded out of order after %v", doc.UUID, last)
+		}
+		if _, found := doc.Tags["Location/Room"]; !found || len(doc.Tags) < 11 {
+			t.Errorf("Document %v yielded incomplete: %v", doc.UUID, doc.Tags)
+		}
+		seen[doc.UUID] = true
+		last = doc.UUID.String()
+	}
+	if err = iter.Err(); err != nil {
+		t.Errorf("Iteration failed: %v", err)
+	}
+	if len(seen) != 5 {
+		t.Errorf("Expected 5 documents but got %d", len(seen))
+	}
+}
+
+func TestTemporalJoin(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	ctx := context.Background()
+	var uids []uuid.UUID
+	for _, s := range []string{"b1c2d3e4-8cbd-11e5-8bb3-0cc47a0f7eea", "b5c6d7e8-8cbd-11e5-8bb3-0cc47a0f7eea", "b9cad0e1-8cbd-11e5-8bb3-0cc47a0f7eea"} {
+		uid, _ := uuid.FromString(s)
+		uids = append(uids, uid)
+		defer removeDocument(backend, uid)
+	}
+	sensor, ahu1, ahu2 := uids[0], uids[1], uids[2]
+	for _, edit := range []struct {
+		doc  uuid.UUID
+		key  string
+		val  string
+		time int64
+	}{
+		{ahu1, "Test/Building", "Soda", 50},
+		{ahu2, "Test/Building", "Cory", 50},
+		// the sensor moves from one AHU to the other, which then moves to Soda
+		{sensor, "Test/AHU", ahu1.String(), 100},
+		{sensor, "Test/AHU", ahu2.String(), 200},
+		{ahu2, "Test/Building", "Soda", 300},
+	} {
+		doc := &Document{UUID: edit.doc, Tags: map[string]string{edit.key: edit.val}}
+		if _, err := backend.InsertWithTimestamp(doc, time.Unix(edit.time, 0), false); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		querystring string
+		matches     bool
+	}{
+		{`select * where Test/AHU -> Test/Building = "Soda" at 150;`, true},
+		{`select * where Test/AHU -> Test/Building = "Soda" at 250;`, false},
+		{`select * where Test/AHU -> Test/Building = "Cory" at 250;`, true},
+		{`select * where Test/AHU -> Test/Building = "Soda";`, true},
+		{`select * where Test/AHU -> Test/Building = "Cory";`, false},
+		// the sensor had no AHU yet
+		{`select * where Test/AHU -> has Test/Building at 75;`, false},
+	} {
+		q, err := backend.Parse(test.querystring)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		docs, err := backend.Eval(ctx, q)
+		if err != nil {
+			t.Fatalf("Eval failed: %v", err)
+		}
+		found := false
+		for _, doc := range docs {
+			found = found || doc.UUID == sensor
+		}
+		if found != test.matches {
+			t.Errorf("Query %v: got match %v but wanted %v", test.querystring, found, test.matches)
+		}
+	}
+}
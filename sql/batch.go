@@ -0,0 +1,272 @@
+package main
+
+import (
+	query "./lang"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"log"
+	"sort"
+	"time"
+)
+
+// A Batch collects edits to any number of documents and applies them in a
+// single transaction on Commit, so readers see either all of them or none.
+// Edits without an explicit timestamp share the batch's transaction timestamp,
+// which is assigned when it commits (see txnClockCreate). Edits to the same
+// document at the same time are merged, with later edits to a key replacing
+// earlier ones. Unless an edit is forced, tags that would not change the value
+// of their key are not written (see changedTags). Edits may also hold only
+// until a later time, after which their keys revert (see InsertInterval)
+type Batch struct {
+	mbd *mysqlBackend
+	ctx context.Context
+	// the transaction timestamp, once committed
+	timestamp time.Time
+	// pending edits in the order they were first made, and the index of the
+	// edit for each document and timestamp
+	edits     []*batchEdit
+	index     map[batchKey]int
+	conflicts []Conflict
+	// the keys each document's edits changed, by UUID, once committed
+	changed map[string][]string
+	done    bool
+}
+
+type batchKey struct {
+	uuid string
+	// UnixNano of the edit's time, or 0 for the batch's timestamp
+	timestamp int64
+	// UnixNano of the end of an interval-valued edit, or 0
+	until int64
+}
+
+type batchEdit struct {
+	doc *Document
+	// ZERO_TIME for the batch's timestamp
+	timestamp time.Time
+	// write every tag, even if it does not change its key. Merging a forced
+	// edit with another forces both
+	force bool
+	// for interval-valued edits, when the tags stop holding; ZERO_TIME if
+	// they hold until the next edit
+	until time.Time
+}
+
+// Begins a batch of edits. The batch is applied when it is committed, and
+// Commit uses ctx
+func (mbd *mysqlBackend) Begin(ctx context.Context) (*Batch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &Batch{mbd: mbd, ctx: ctx, index: map[batchKey]int{}}, nil
+}
+
+// Returns the transaction timestamp of a committed batch, at which edits
+// without an explicit timestamp were applied
+func (b *Batch) Timestamp() time.Time {
+	return b.timestamp
+}
+
+// Returns the edits of earlier transactions that this batch replaced once it
+// committed (see Conflict)
+func (b *Batch) Conflicts() []Conflict {
+	return b.conflicts
+}
+
+// Returns the keys of each document, by UUID, whose values the committed
+// batch changed
+func (b *Batch) Changed() map[string][]string {
+	return b.changed
+}
+
+// Adds the document's tags to the batch at the batch's timestamp. If force is
+// true, every tag is written even if it does not change its key
+func (b *Batch) Insert(doc *Document, force bool) error {
+	return b.add(doc, ZERO_TIME, ZERO_TIME, force)
+}
+
+// Adds the document's tags to the batch at the given time. If force is true,
+// every tag is written even if it does not change its key
+func (b *Batch) InsertWithTimestamp(doc *Document, timestamp time.Time, force bool) error {
+	return b.add(doc, timestamp, ZERO_TIME, force)
+}
+
+// Adds the document's tags to the batch as facts that hold from timestamp (or
+// the batch's timestamp if it is zero) until, but not including, until. At
+// until each key reverts to the value it would have had without the edit, or
+// is removed if it would not be set; keys edited at until keep that edit. The
+// reverting edit is an ordinary edit, so every query sees the interval
+func (b *Batch) InsertInterval(doc *Document, timestamp, until time.Time, force bool) error {
+	if until == ZERO_TIME || (timestamp != ZERO_TIME && !until.After(timestamp)) {
+		return fmt.Errorf("Interval of %v must end after it starts", doc.UUID)
+	}
+	return b.add(doc, timestamp, until, force)
+}
+
+func (b *Batch) add(doc *Document, timestamp, until time.Time, force bool) error {
+	if b.done {
+		return sql.ErrTxDone
+	}
+	if len(doc.Tags) == 0 {
+		return nil
+	}
+	timestamp, until = storedTime(timestamp), storedTime(until)
+	key := batchKey{uuid: doc.UUID.String()}
+	if timestamp != ZERO_TIME {
+		key.timestamp = timestamp.UnixNano()
+	}
+	if until != ZERO_TIME {
+		key.until = until.UnixNano()
+	}
+	idx, found := b.index[key]
+	if !found {
+		idx = len(b.edits)
+		b.index[key] = idx
+		b.edits = append(b.edits, &batchEdit{
+			doc:       &Document{UUID: doc.UUID, Tags: map[string]string{}},
+			timestamp: timestamp,
+			until:     until,
+		})
+	}
+	for k, v := range doc.Tags {
+		b.edits[idx].doc.Tags[k] = v
+	}
+	b.edits[idx].force = b.edits[idx].force || force
+	return nil
+}
+
+// Applies every edit in the batch in one transaction. If any edit fails, none
+// are applied. Batches run concurrently; a batch that conflicts with one that
+// committed edits to the same documents first is retried with a new
+// transaction timestamp, and ErrConflict is returned if it keeps conflicting
+func (b *Batch) Commit() error {
+	if b.done {
+		return sql.ErrTxDone
+	}
+	b.done = true
+	if len(b.edits) == 0 {
+		return nil
+	}
+	var (
+		uids      []uuid.UUID
+		seen      = map[uuid.UUID]bool{}
+		conflicts []Conflict
+		changed   map[string][]string
+	)
+	for _, edit := range b.edits {
+		if !seen[edit.doc.UUID] {
+			seen[edit.doc.UUID] = true
+			uids = append(uids, edit.doc.UUID)
+		}
+	}
+	timestamp, err := b.mbd.writeTx(b.ctx, uids, func(tx *sql.Tx, timestamp time.Time) error {
+		conflicts, changed = nil, map[string][]string{}
+		// the earliest edit to each document that changed it, in order of
+		// first appearance
+		earliest := map[uuid.UUID]time.Time{}
+		var docs []uuid.UUID
+		for _, edit := range b.ordered(timestamp) {
+			keys, replaced, err := b.apply(tx, edit)
+			if err != nil {
+				return err
+			}
+			conflicts = append(conflicts, replaced...)
+			if len(keys) == 0 {
+				continue
+			}
+			changed[edit.doc.UUID.String()] = mergeKeys(changed[edit.doc.UUID.String()], keys)
+			if _, found := earliest[edit.doc.UUID]; !found {
+				earliest[edit.doc.UUID] = edit.timestamp
+				docs = append(docs, edit.doc.UUID)
+			}
+		}
+		// edits may arrive late, so checkpoints after the earliest edit to a
+		// document are stale. They are invalidated and rewritten once per
+		// document rather than once per edit
+		for _, uid := range docs {
+			if err := invalidateCheckpoints(b.ctx, tx, uid, earliest[uid]); err != nil {
+				return err
+			}
+			if err := b.mbd.maybeCheckpoint(b.ctx, tx, uid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.timestamp = timestamp
+	b.conflicts = conflicts
+	b.changed = changed
+	for _, conflict := range conflicts {
+		log.Printf("Conflicting edit resolved in favor of transaction %s: %v", query.SQLTime(timestamp), conflict)
+	}
+	return nil
+}
+
+// Inserts the edit and, for an interval-valued edit, the edit that ends it.
+// Returns the keys that were written and the edits that were replaced
+func (b *Batch) apply(tx *sql.Tx, edit *batchEdit) ([]string, []Conflict, error) {
+	if edit.until == ZERO_TIME {
+		return insertAt(b.ctx, tx, edit.doc, edit.timestamp, edit.force)
+	}
+	if !edit.until.After(edit.timestamp) {
+		return nil, nil, fmt.Errorf("Interval of %v must end after it starts", edit.doc.UUID)
+	}
+	revert, err := revertTags(b.ctx, tx, edit.doc, edit.until)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys, conflicts, err := insertAt(b.ctx, tx, edit.doc, edit.timestamp, edit.force)
+	if err != nil {
+		return nil, nil, err
+	}
+	reverted, replaced, err := insertAt(b.ctx, tx, revert, edit.until, edit.force)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mergeKeys(keys, reverted), append(conflicts, replaced...), nil
+}
+
+// Returns the edits in valid time order, with edits at the batch's timestamp
+// given the transaction timestamp. Edits at the same time keep the order in
+// which they were made
+func (b *Batch) ordered(timestamp time.Time) []*batchEdit {
+	ordered := make([]*batchEdit, len(b.edits))
+	for idx, edit := range b.edits {
+		ordered[idx] = edit
+		if edit.timestamp == ZERO_TIME {
+			ordered[idx] = &batchEdit{doc: edit.doc, timestamp: timestamp, force: edit.force, until: edit.until}
+		}
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].timestamp.Before(ordered[j].timestamp)
+	})
+	return ordered
+}
+
+// Discards the edits in the batch
+func (b *Batch) Rollback() error {
+	if b.done {
+		return sql.ErrTxDone
+	}
+	b.done = true
+	b.edits = nil
+	return nil
+}
+
+// Returns the sorted union of two sorted lists of keys
+func mergeKeys(keys, more []string) []string {
+	merged := append(keys, more...)
+	sort.Strings(merged)
+	unique := merged[:0]
+	for _, key := range merged {
+		if len(unique) == 0 || key != unique[len(unique)-1] {
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchMergesEdits(t *testing.T) {
+	uuid1, _ := uuid.FromString("aa45f708-8be8-11e5-86ae-5cc5d4ded1ae")
+	uuid2, _ := uuid.FromString("bb45f708-8be8-11e5-86ae-5cc5d4ded1ae")
+	batch := &Batch{index: map[batchKey]int{}}
+	batch.Insert(&Document{UUID: uuid1, Tags: map[string]string{"key1": "a", "key2": "b"}}, false)
+	batch.Insert(&Document{UUID: uuid2, Tags: map[string]string{"key1": "c"}}, false)
+	batch.Insert(&Document{UUID: uuid1, Tags: map[string]string{"key1": ""}}, true)
+	batch.InsertWithTimestamp(&Document{UUID: uuid1, Tags: map[string]string{"key1": "d"}}, time.Unix(5, 0).UTC(), false)
+	batch.Insert(&Document{UUID: uuid1}, false)
+	// an interval-valued edit is not merged with edits at the same time
+	batch.InsertInterval(&Document{UUID: uuid1, Tags: map[string]string{"key2": "e"}}, time.Unix(5, 0).UTC(), time.Unix(9, 0).UTC(), false)
+	if err := batch.InsertInterval(&Document{UUID: uuid1, Tags: map[string]string{"key2": "f"}}, time.Unix(5, 0).UTC(), time.Unix(5, 0).UTC(), false); err == nil {
+		t.Errorf("Expected an error for an empty interval")
+	}
+
+	expected := []*batchEdit{
+		{&Document{UUID: uuid1, Tags: map[string]string{"key1": "", "key2": "b"}}, ZERO_TIME, true, ZERO_TIME},
+		{&Document{UUID: uuid2, Tags: map[string]string{"key1": "c"}}, ZERO_TIME, false, ZERO_TIME},
+		{&Document{UUID: uuid1, Tags: map[string]string{"key1": "d"}}, time.Unix(5, 0).UTC(), false, ZERO_TIME},
+		{&Document{UUID: uuid1, Tags: map[string]string{"key2": "e"}}, time.Unix(5, 0).UTC(), false, time.Unix(9, 0).UTC()},
+	}
+	if len(batch.edits) != len(expected) {
+		t.Fatalf("Got %d edits but wanted %d", len(batch.edits), len(expected))
+	}
+	for idx, edit := range batch.edits {
+		if !reflect.DeepEqual(edit, expected[idx]) {
+			t.Errorf("Got edit %v %v at %v (force %v) but wanted %v %v at %v (force %v)", edit.doc.UUID, edit.doc.Tags, edit.timestamp, edit.force,
+				expected[idx].doc.UUID, expected[idx].doc.Tags, expected[idx].timestamp, expected[idx].force)
+		}
+	}
+
+	if err := batch.Rollback(); err != nil {
+		t.Errorf("Rollback failed: %v", err)
+	}
+	if err := batch.Insert(&Document{UUID: uuid1, Tags: map[string]string{"key1": "a"}}, false); err != sql.ErrTxDone {
+		t.Errorf("Expected %v after rollback but got %v", sql.ErrTxDone, err)
+	}
+	if err := batch.Commit(); err != sql.ErrTxDone {
+		t.Errorf("Expected %v after rollback but got %v", sql.ErrTxDone, err)
+	}
+}
+
+func TestBatchOrdersEdits(t *testing.T) {
+	uuid1, _ := uuid.FromString("aa45f708-8be8-11e5-86ae-5cc5d4ded1ae")
+	batch := &Batch{index: map[batchKey]int{}}
+	for _, at := range []int64{30, 10, 0, 20, 5} {
+		var timestamp time.Time
+		if at > 0 {
+			timestamp = time.Unix(at, 0)
+		}
+		batch.InsertWithTimestamp(&Document{UUID: uuid1, Tags: map[string]string{"key": fmt.Sprintf("%d", at)}}, timestamp, false)
+	}
+	var got []string
+	for _, edit := range batch.ordered(time.Unix(25, 0)) {
+		got = append(got, edit.doc.Tags["key"])
+	}
+	if expected := []string{"5", "10", "20", "0", "30"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got edits in order %v but wanted %v", got, expected)
+	}
+}
+
+func TestBatchTruncatesToMicroseconds(t *testing.T) {
+	uuid1, _ := uuid.FromString("aa45f708-8be8-11e5-86ae-5cc5d4ded1ae")
+	batch := &Batch{index: map[batchKey]int{}}
+	// both edits are stored at the same microsecond, so they are one edit
+	batch.InsertWithTimestamp(&Document{UUID: uuid1, Tags: map[string]string{"key1": "a"}}, time.Unix(5, 1000), false)
+	batch.InsertWithTimestamp(&Document{UUID: uuid1, Tags: map[string]string{"key1": "b"}}, time.Unix(5, 1999), false)
+	batch.InsertWithTimestamp(&Document{UUID: uuid1, Tags: map[string]string{"key1": "c"}}, time.Unix(5, 2000), false)
+	if len(batch.edits) != 2 {
+		t.Fatalf("Got %d edits but wanted 2", len(batch.edits))
+	}
+	if edit := batch.edits[0]; edit.doc.Tags["key1"] != "b" || !edit.timestamp.Equal(time.Unix(5, 1000)) {
+		t.Errorf("Got %v at %v but wanted b at %v", edit.doc.Tags, edit.timestamp, time.Unix(5, 1000))
+	}
+}
+
+func TestMergeKeys(t *testing.T) {
+	got := mergeKeys([]string{"a", "c"}, []string{"b", "c", "d"})
+	if expected := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got keys %v but wanted %v", got, expected)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	ctx := context.Background()
+	uuid1, _ := uuid.FromString("a1b2c3d4-8cbd-11e5-8bb3-0cc47a0f7eea")
+	uuid2, _ := uuid.FromString("a5b6c7d8-8cbd-11e5-8bb3-0cc47a0f7eea")
+	defer removeDocument(backend, uuid1)
+	defer removeDocument(backend, uuid2)
+
+	// rolled back edits are never applied
+	batch, err := backend.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	batch.Insert(&Document{UUID: uuid1, Tags: map[string]string{"Test/Batch": "rolled back"}}, false)
+	if err = batch.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	if doc, _ := backend.CurrentDocument(ctx, uuid1); len(doc.Tags) != 0 {
+		t.Errorf("Expected no tags after rollback but got %v", doc.Tags)
+	}
+
+	// a failing edit aborts the whole batch
+	batch, err = backend.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	batch.Insert(&Document{UUID: uuid1, Tags: map[string]string{"Test/Batch": "aborted"}}, false)
+	batch.Insert(&Document{UUID: uuid2, Tags: map[string]string{"Test/Batch": strings.Repeat("x", 1000)}}, false)
+	if err = batch.Commit(); err == nil {
+		t.Errorf("Expected an error committing a value longer than the dval column")
+	}
+	if doc, _ := backend.CurrentDocument(ctx, uuid1); len(doc.Tags) != 0 {
+		t.Errorf("Expected no tags after a failed commit but got %v", doc.Tags)
+	}
+
+	// committed edits share the batch's timestamp
+	batch, err = backend.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	batch.Insert(&Document{UUID: uuid1, Tags: map[string]string{"Test/Batch": "committed"}}, false)
+	batch.Insert(&Document{UUID: uuid2, Tags: map[string]string{"Test/Batch": "committed"}}, false)
+	if err = batch.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	doc1, err := backend.CurrentDocument(ctx, uuid1)
+	if err != nil {
+		t.Fatalf("CurrentDocument failed: %v", err)
+	}
+	doc2, err := backend.CurrentDocument(ctx, uuid2)
+	if err != nil {
+		t.Fatalf("CurrentDocument failed: %v", err)
+	}
+	if doc1.Tags["Test/Batch"] != "committed" || doc2.Tags["Test/Batch"] != "committed" {
+		t.Errorf("Expected both documents to be committed but got %v and %v", doc1.Tags, doc2.Tags)
+	}
+	if !doc1.TagTimes["Test/Batch"].Equal(doc2.TagTimes["Test/Batch"]) {
+		t.Errorf("Expected edits in a batch to share a timestamp but got %v and %v", doc1.TagTimes["Test/Batch"], doc2.TagTimes["Test/Batch"])
+	}
+}
+
+func TestShuffledInserts(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	backend.checkpointEdits = 5
+	ctx := context.Background()
+	var uids []uuid.UUID
+	for _, s := range []string{"d1a2b3c4-8cbd-11e5-8bb3-0cc47a0f7eea", "d5a6b7c8-8cbd-11e5-8bb3-0cc47a0f7eea", "d9aab0c1-8cbd-11e5-8bb3-0cc47a0f7eea"} {
+		uid, _ := uuid.FromString(s)
+		uids = append(uids, uid)
+		defer removeDocument(backend, uid)
+	}
+
+	type edit struct {
+		doc  *Document
+		time time.Time
+	}
+	var (
+		rng   = rand.New(rand.NewSource(42))
+		edits []edit
+	)
+	for i := 0; i < 180; i++ {
+		key := fmt.Sprintf("Test/Key%d", rng.Intn(4))
+		val := fmt.Sprintf("%d", i)
+		if rng.Intn(5) == 0 {
+			val = "" // removes the key
+		}
+		edits = append(edits, edit{&Document{UUID: uids[i%3], Tags: map[string]string{key: val}}, time.Unix(int64(2000+i), 0)})
+	}
+	// the expected version of each document after each edit, built from the
+	// edits in time order
+	expected := func(uid uuid.UUID, at time.Time) map[string]string {
+		tags := map[string]string{}
+		for _, e := range edits {
+			if e.doc.UUID != uid || e.time.After(at) {
+				continue
+			}
+			for k, v := range e.doc.Tags {
+				if v == "" {
+					delete(tags, k)
+				} else {
+					tags[k] = v
+				}
+			}
+		}
+		return tags
+	}
+
+	// apply the edits in a random order, alone and in batches
+	shuffled := rng.Perm(len(edits))
+	for len(shuffled) > 0 {
+		size := 1 + rng.Intn(20)
+		if size > len(shuffled) {
+			size = len(shuffled)
+		}
+		batch, err := backend.Begin(ctx)
+		if err != nil {
+			t.Fatalf("Begin failed: %v", err)
+		}
+		for _, idx := range shuffled[:size] {
+			// an edit that is a no-op when it arrives may not be once the
+			// edits before it arrive, so every edit is written
+			batch.InsertWithTimestamp(edits[idx].doc, edits[idx].time, true)
+		}
+		if err = batch.Commit(); err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+		shuffled = shuffled[size:]
+	}
+
+	for _, uid := range uids {
+		current, err := backend.CurrentDocument(ctx, uid)
+		if err != nil {
+			t.Fatalf("CurrentDocument failed: %v", err)
+		}
+		if want := expected(uid, MAX_TIME); !reflect.DeepEqual(current.Tags, want) {
+			t.Errorf("Current %v: got %v but wanted %v", uid, current.Tags, want)
+		}
+		for i := 0; i < len(edits); i += 7 {
+			at := time.Unix(int64(2000+i), 0)
+			doc, err := backend.DocumentAt(ctx, uid, at)
+			if err != nil {
+				t.Fatalf("DocumentAt failed: %v", err)
+			}
+			if want := expected(uid, at); !reflect.DeepEqual(doc.Tags, want) {
+				t.Errorf("DocumentAt %v %v: got %v but wanted %v", uid, at, doc.Tags, want)
+			}
+		}
+
+		// every checkpoint must match the history before it
+		rows, err := backend.db.Query("SELECT timestamp, document FROM checkpoints WHERE uuid = ?;", uid.String())
+		if err != nil {
+			t.Fatalf("Could not read checkpoints: %v", err)
+		}
+		count := 0
+		for rows.Next() {
+			var (
+				at       time.Time
+				encoded  string
+				snapshot Document
+			)
+			if err = rows.Scan(&at, &encoded); err != nil {
+				t.Fatalf("Could not read checkpoint: %v", err)
+			}
+			json.Unmarshal([]byte(encoded), &snapshot)
+			if want := expected(uid, at); !reflect.DeepEqual(snapshot.Tags, want) && !(len(want) == 0 && len(snapshot.Tags) == 0) {
+				t.Errorf("Checkpoint %v %v: got %v but wanted %v", uid, at, snapshot.Tags, want)
+			}
+			count += 1
+		}
+		rows.Close()
+		if count < 60/5 {
+			t.Errorf("Expected at least %d checkpoints of %v but got %d", 60/5, uid, count)
+		}
+	}
+}
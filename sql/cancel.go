@@ -0,0 +1,83 @@
+package main
+
+import (
+	query "./lang"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// Runs a query that can be cancelled through ctx. When ctx is done before the
+// query finishes, the driver only closes its end of the connection, which
+// MySQL does not notice until it has results to send, so the query is also
+// killed on the server. The returned function releases the connection and must
+// be called once the rows are closed
+func (mbd *mysqlBackend) queryKillable(ctx context.Context, db queryer, querystring string, args ...interface{}) (*sql.Rows, func(), error) {
+	var (
+		conn *sql.Conn
+		id   int64
+		err  error
+	)
+	// pin the query to a connection so we know which one to kill
+	if pool, ok := db.(*sql.DB); ok {
+		if conn, err = pool.Conn(ctx); err != nil {
+			return nil, nil, contextError(ctx, err)
+		}
+		db = conn
+	}
+	closeConn := func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	if err = db.QueryRowContext(ctx, "select connection_id();").Scan(&id); err != nil {
+		closeConn()
+		return nil, nil, contextError(ctx, err)
+	}
+
+	var (
+		finished = make(chan struct{})
+		exited   = make(chan struct{})
+	)
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			// ctx is already done, so the kill runs without it
+			if _, err := mbd.db.Exec(fmt.Sprintf("KILL QUERY %d;", id)); err != nil {
+				log.Printf("Could not kill cancelled query on connection %d: %v", id, err)
+			}
+		case <-finished:
+		}
+	}()
+	// wait for the watcher so that it cannot kill a later query on the same
+	// connection once it has gone back to the pool
+	release := func() {
+		close(finished)
+		<-exited
+		closeConn()
+	}
+
+	rows, err := db.QueryContext(ctx, querystring, args...)
+	if err != nil {
+		release()
+		return nil, nil, contextError(ctx, err)
+	}
+	return rows, release, nil
+}
+
+// Replaces an error caused by ctx being done with a QueryError saying whether
+// the query timed out or was cancelled
+func contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return &query.QueryError{Kind: query.TimeoutError, Message: "query exceeded its time limit"}
+	case context.Canceled:
+		return &query.QueryError{Kind: query.CanceledError, Message: "query was cancelled"}
+	}
+	return err
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	query "./lang"
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEvalCancelled(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+
+	q, err := backend.Parse(`select * where has Location/Room;`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = backend.Eval(cancelled, q); err == nil {
+		t.Errorf("Expected cancelled query to fail")
+	} else if qe, ok := err.(*query.QueryError); !ok || qe.Kind != query.CanceledError {
+		t.Errorf("Expected canceled error but got %#v", err)
+	}
+
+	backend.timeout = time.Nanosecond
+	if _, err = backend.Eval(context.Background(), q); err == nil {
+		t.Errorf("Expected query to time out")
+	} else if qe, ok := err.(*query.QueryError); !ok || qe.Kind != query.TimeoutError {
+		t.Errorf("Expected timeout error but got %#v", err)
+	}
+}
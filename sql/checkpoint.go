@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/satori/go.uuid"
+	"time"
+)
+
+// A checkpoint is the full document as of its timestamp, stored as the JSON
+// encoding of the Document. A document at time t is rebuilt from the latest
+// checkpoint at or before t plus the edits made after that checkpoint, rather
+// than from the whole history
+var checkpointsCreate = `
+CREATE TABLE IF NOT EXISTS checkpoints
+(
+    uuid CHAR(37) NOT NULL,
+    timestamp TIMESTAMP(6) NOT NULL,
+    document MEDIUMTEXT NOT NULL,
+    PRIMARY KEY (uuid, timestamp)
+);
+`
+
+var checkpointTemplate = `
+select timestamp, document from checkpoints
+where uuid = ? and timestamp <= ?
+order by timestamp desc limit 1;
+`
+
+var replayTemplate = `
+select dkey, dval, timestamp from data
+where uuid = ? and timestamp <= ?
+order by timestamp asc;
+`
+
+var replaySinceTemplate = `
+select dkey, dval, timestamp from data
+where uuid = ? and timestamp > ? and timestamp <= ?
+order by timestamp asc;
+`
+
+var lastCheckpointTemplate = `
+select timestamp from checkpoints where uuid = ?
+order by timestamp desc limit 1;
+`
+
+// the edits made to a document since its last checkpoint (or ever, if it
+// has none). Returns no rows if there are none
+var editsTemplate = `
+select count(distinct timestamp), min(timestamp), max(timestamp) from data
+where uuid = ?
+having count(*) > 0;
+`
+
+var editsSinceTemplate = `
+select count(distinct timestamp), min(timestamp), max(timestamp) from data
+where uuid = ? and timestamp > ?
+having count(*) > 0;
+`
+
+var checkpointInsert = `
+insert into checkpoints (uuid, timestamp, document) values (?, ?, ?)
+on duplicate key update document = values(document);
+`
+
+var checkpointsInvalidate = `
+delete from checkpoints where uuid = ? and timestamp >= ?;
+`
+
+// Rebuilds the document as of the given time by replaying its edits in
+// order. If useCheckpoints is true, replay starts from the latest checkpoint
+// at or before that time
+func (mbd *mysqlBackend) documentAt(ctx context.Context, db queryer, uid uuid.UUID, at time.Time, useCheckpoints bool) (*Document, error) {
+	var (
+		doc   = &Document{UUID: uid, Tags: map[string]string{}, TagTimes: map[string]time.Time{}}
+		since time.Time
+		found bool
+		err   error
+	)
+	if useCheckpoints {
+		if doc, since, found, err = loadCheckpoint(ctx, db, uid, at); err != nil {
+			return nil, err
+		}
+	}
+	err = replay(ctx, db, uid, since, found, at, func(dkey string, dval sql.NullString, dtime time.Time) {
+		doc.replayRow(dkey, dval, dtime)
+	})
+	if err != nil {
+		return nil, err
+	}
+	doc.setValidTime(at)
+	return doc, nil
+}
+
+// Returns the latest checkpoint of the document at or before the given time
+// and the time of that checkpoint. If there is none, found is false and the
+// returned document is empty
+func loadCheckpoint(ctx context.Context, db queryer, uid uuid.UUID, at time.Time) (doc *Document, since time.Time, found bool, err error) {
+	var encoded string
+	doc = &Document{UUID: uid, Tags: map[string]string{}, TagTimes: map[string]time.Time{}}
+	err = db.QueryRowContext(ctx, checkpointTemplate, uid.String(), at).Scan(&since, &encoded)
+	if err == sql.ErrNoRows {
+		return doc, since, false, nil
+	} else if err != nil {
+		return nil, since, false, err
+	}
+	if err = json.Unmarshal([]byte(encoded), doc); err != nil {
+		return nil, since, false, err
+	}
+	if doc.Tags == nil {
+		doc.Tags = map[string]string{}
+	}
+	if doc.TagTimes == nil {
+		doc.TagTimes = map[string]time.Time{}
+	}
+	return doc, since, true, nil
+}
+
+// Calls apply for each row of the document's history in timestamp order, up
+// to the given time and, if bounded is true, after since
+func replay(ctx context.Context, db queryer, uid uuid.UUID, since time.Time, bounded bool, at time.Time, apply func(dkey string, dval sql.NullString, dtime time.Time)) error {
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	if bounded {
+		rows, err = db.QueryContext(ctx, replaySinceTemplate, uid.String(), since, at)
+	} else {
+		rows, err = db.QueryContext(ctx, replayTemplate, uid.String(), at)
+	}
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			dkey  string
+			dval  sql.NullString
+			dtime time.Time
+		)
+		if err = rows.Scan(&dkey, &dval, &dtime); err != nil {
+			return err
+		}
+		apply(dkey, dval, dtime)
+	}
+	return rows.Err()
+}
+
+// Removes the checkpoints of the document that an edit at the given time
+// makes stale: every checkpoint at or after it. They are written again by
+// the next call to maybeCheckpoint
+func invalidateCheckpoints(ctx context.Context, db queryer, uid uuid.UUID, since time.Time) error {
+	_, err := db.ExecContext(ctx, checkpointsInvalidate, uid.String(), since)
+	return err
+}
+
+// Writes checkpoints of the document if enough edits have been made or
+// enough time has passed since its last checkpoint
+func (mbd *mysqlBackend) maybeCheckpoint(ctx context.Context, db queryer, uid uuid.UUID) error {
+	if mbd.checkpointEdits <= 0 && mbd.checkpointInterval <= 0 {
+		return nil
+	}
+	var (
+		last          time.Time
+		edits         int
+		first, latest time.Time
+	)
+	err := db.QueryRowContext(ctx, lastCheckpointTemplate, uid.String()).Scan(&last)
+	switch {
+	case err == sql.ErrNoRows:
+		err = db.QueryRowContext(ctx, editsTemplate, uid.String()).Scan(&edits, &first, &latest)
+	case err != nil:
+		return err
+	default:
+		err = db.QueryRowContext(ctx, editsSinceTemplate, uid.String(), last).Scan(&edits, &first, &latest)
+		// the interval is measured from the last checkpoint
+		first = last
+	}
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !mbd.checkpointDue(edits, latest.Sub(first)) {
+		return nil
+	}
+	return mbd.writeCheckpoints(ctx, db, uid)
+}
+
+func (mbd *mysqlBackend) checkpointDue(edits int, span time.Duration) bool {
+	return (mbd.checkpointEdits > 0 && edits >= mbd.checkpointEdits) ||
+		(mbd.checkpointInterval > 0 && span >= mbd.checkpointInterval)
+}
+
+// Replays the edits made since the document's last checkpoint, writing a
+// checkpoint wherever one is due. After invalidateCheckpoints or a late
+// upload, this restores the checkpoint density over the whole replayed range
+// rather than only at its end
+func (mbd *mysqlBackend) writeCheckpoints(ctx context.Context, db queryer, uid uuid.UUID) error {
+	doc, since, found, err := loadCheckpoint(ctx, db, uid, MAX_TIME)
+	if err != nil {
+		return err
+	}
+	var (
+		checkpoints []*Document
+		edits       int
+		start       = since
+		previous    time.Time
+	)
+	// a checkpoint is written once all of the rows of an edit (which share a
+	// timestamp) have been applied
+	due := func() {
+		if edits == 0 || !mbd.checkpointDue(edits, previous.Sub(start)) {
+			return
+		}
+		checkpoint := &Document{UUID: uid, Tags: map[string]string{}, TagTimes: map[string]time.Time{}, ValidTime: previous}
+		for k, v := range doc.Tags {
+			checkpoint.Tags[k] = v
+			checkpoint.TagTimes[k] = doc.TagTimes[k]
+		}
+		checkpoints = append(checkpoints, checkpoint)
+		edits = 0
+		start = previous
+	}
+	err = replay(ctx, db, uid, since, found, MAX_TIME, func(dkey string, dval sql.NullString, dtime time.Time) {
+		if !dtime.Equal(previous) {
+			due()
+			if edits == 0 && !found && len(checkpoints) == 0 {
+				// without a checkpoint, the interval is measured from the
+				// first edit
+				start = dtime
+			}
+			edits += 1
+			previous = dtime
+		}
+		doc.replayRow(dkey, dval, dtime)
+	})
+	if err != nil {
+		return err
+	}
+	due()
+	// the rows must be closed before writing, since db may be a transaction
+	for _, checkpoint := range checkpoints {
+		encoded, err := json.Marshal(checkpoint)
+		if err != nil {
+			return err
+		}
+		if _, err = db.ExecContext(ctx, checkpointInsert, uid.String(), checkpoint.ValidTime, string(encoded)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckpoints(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	backend.checkpointEdits = 4
+	ctx := context.Background()
+	uid, _ := uuid.FromString("f1d2c3b4-8cbd-11e5-8bb3-0cc47a0f7eea")
+	defer removeDocument(backend, uid)
+
+	if err := insertEdits(backend, uid, 30); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	var checkpoints int
+	if err := backend.db.QueryRow("SELECT COUNT(*) FROM checkpoints WHERE uuid = ?;", uid.String()).Scan(&checkpoints); err != nil {
+		t.Fatalf("Could not count checkpoints: %v", err)
+	}
+	if checkpoints != 7 {
+		t.Errorf("Expected 7 checkpoints for 30 edits but got %d", checkpoints)
+	}
+
+	// reading from checkpoints must give the same documents as replaying
+	// every edit
+	for i := 0; i < 32; i++ {
+		at := time.Unix(int64(999+i), 0)
+		fromCheckpoint, err := backend.documentAt(ctx, backend.db, uid, at, true)
+		if err != nil {
+			t.Fatalf("documentAt %v failed: %v", at, err)
+		}
+		replayed, err := backend.documentAt(ctx, backend.db, uid, at, false)
+		if err != nil {
+			t.Fatalf("documentAt %v failed: %v", at, err)
+		}
+		if !reflect.DeepEqual(fromCheckpoint.Tags, replayed.Tags) {
+			t.Errorf("documentAt %v: got %v from checkpoints but %v from replay", at, fromCheckpoint.Tags, replayed.Tags)
+		}
+	}
+}
+
+func benchmarkDocumentAt(b *testing.B, useCheckpoints bool) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	backend.checkpointEdits = 100
+	ctx := context.Background()
+	uid, _ := uuid.FromString("f5e6d7c8-8cbd-11e5-8bb3-0cc47a0f7eea")
+	defer removeDocument(backend, uid)
+	if err := insertEdits(backend, uid, 2000); err != nil {
+		b.Fatalf("Insert failed: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		at := time.Unix(int64(1000+(i*37)%2000), 0)
+		if _, err := backend.documentAt(ctx, backend.db, uid, at, useCheckpoints); err != nil {
+			b.Fatalf("documentAt failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkDocumentAtCheckpoints(b *testing.B) { benchmarkDocumentAt(b, true) }
+func BenchmarkDocumentAtReplay(b *testing.B)      { benchmarkDocumentAt(b, false) }
+
+// inserts edits to the given document at Unix times 1000, 1001, ... that
+// cycle through a few values of a few keys, removing one every 7 edits
+func insertEdits(backend *mysqlBackend, uid uuid.UUID, count int) error {
+	for i := 0; i < count; i++ {
+		tags := map[string]string{fmt.Sprintf("Test/Key%d", i%5): fmt.Sprintf("%d", i)}
+		if i%7 == 6 {
+			tags[fmt.Sprintf("Test/Key%d", (i+1)%5)] = ""
+		}
+		if _, err := backend.InsertWithTimestamp(&Document{UUID: uid, Tags: tags}, time.Unix(int64(1000+i), 0), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
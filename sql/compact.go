@@ -0,0 +1,246 @@
+package main
+
+import (
+	query "./lang"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A RetentionPolicy limits how long the history of keys starting with Prefix
+// is kept. Edits older than Keep are removed, except for the last one before
+// that cutoff, so that the value of every key at any time within the
+// retained window is unchanged. A Keep of 0 keeps every edit
+type RetentionPolicy struct {
+	Prefix string
+	Keep   time.Duration
+}
+
+// Parses a comma-separated list of policies such as
+// "Location/*=0,Status/*=90d". The trailing "*" of a prefix is optional
+func parseRetention(s string) ([]RetentionPolicy, error) {
+	var policies []RetentionPolicy
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid retention policy %q (expected prefix=duration)", field)
+		}
+		keep, err := query.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid retention policy %q (%v)", field, err)
+		}
+		policies = append(policies, RetentionPolicy{Prefix: strings.TrimSuffix(strings.TrimSpace(parts[0]), "*"), Keep: keep})
+	}
+	return policies, nil
+}
+
+// Returns how long the history of the key is kept: the Keep of the policy
+// with the longest prefix of the key, or 0 (forever) if none matches
+func retentionFor(policies []RetentionPolicy, key string) time.Duration {
+	var best *RetentionPolicy
+	for idx := range policies {
+		if strings.HasPrefix(key, policies[idx].Prefix) && (best == nil || len(policies[idx].Prefix) > len(best.Prefix)) {
+			best = &policies[idx]
+		}
+	}
+	if best == nil {
+		return 0
+	}
+	return best.Keep
+}
+
+// a row of a document's history considered for compaction
+type compactRow struct {
+	key  string
+	val  sql.NullString
+	time time.Time
+}
+
+// Returns the rows of a document's history that compaction removes: edits
+// that set a key to the value it already had, and edits that are older than
+// the key's retention cutoff and not the last edit before it. The last edit
+// before the cutoff is also removed if it removed the key. Rows must be
+// ordered by key, then time
+func compactRows(rows []compactRow, policies []RetentionPolicy, now time.Time) []compactRow {
+	var removed []compactRow
+	for start := 0; start < len(rows); {
+		end := start
+		for end < len(rows) && rows[end].key == rows[start].key {
+			end++
+		}
+		removed = append(removed, compactKey(rows[start:end], retentionFor(policies, rows[start].key), now)...)
+		start = end
+	}
+	return removed
+}
+
+func compactKey(rows []compactRow, keep time.Duration, now time.Time) []compactRow {
+	var (
+		removed []compactRow
+		kept    []compactRow
+		// the value before the first edit: not set
+		previous sql.NullString
+	)
+	// coalesce runs of the same value into their first edit. Removing a key
+	// that is not set is also a no-op
+	for _, row := range rows {
+		if row.val == previous {
+			removed = append(removed, row)
+			continue
+		}
+		kept = append(kept, row)
+		previous = row.val
+	}
+	if keep <= 0 {
+		return removed
+	}
+	cutoff := now.Add(-keep)
+	// the edits before the cutoff, of which only the last is needed
+	before := sort.Search(len(kept), func(i int) bool { return !kept[i].time.Before(cutoff) })
+	if before == 0 {
+		return removed
+	}
+	removed = append(removed, kept[:before-1]...)
+	if last := kept[before-1]; !last.val.Valid {
+		removed = append(removed, last)
+	}
+	return removed
+}
+
+var compactDocuments = `select distinct uuid from data;`
+
+var compactHistoryTemplate = `
+select dkey, dval, timestamp from data
+where uuid = ?
+order by dkey asc, timestamp asc;
+`
+
+// legacy tables may hold identical rows, of which compaction removes one at a
+// time
+var compactDeleteTemplate = `
+delete from data
+where uuid = ? and dkey = ? and timestamp = ? and dval <=> ?
+limit 1;
+`
+
+// The outcome of a compaction
+type CompactStats struct {
+	Documents int
+	Removed   int
+}
+
+// Removes the edits of every document that its retention policies no longer
+// require, and coalesces edits that did not change a value. The value of every
+// key at any time within its retained window is the same afterwards. Each
+// document is compacted in its own transaction, between batches of edits
+func (mbd *mysqlBackend) Compact(ctx context.Context, policies []RetentionPolicy, now time.Time) (CompactStats, error) {
+	var stats CompactStats
+	rows, err := mbd.db.QueryContext(ctx, compactDocuments)
+	if err != nil {
+		return stats, err
+	}
+	var uids []uuid.UUID
+	for rows.Next() {
+		var duuid string
+		if err = rows.Scan(&duuid); err != nil {
+			rows.Close()
+			return stats, err
+		}
+		uid, err := uuid.FromString(duuid)
+		if err != nil {
+			rows.Close()
+			return stats, err
+		}
+		uids = append(uids, uid)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return stats, err
+	}
+	for _, uid := range uids {
+		removed, err := mbd.compactDocument(ctx, uid, policies, now)
+		if err != nil {
+			return stats, err
+		}
+		stats.Documents += 1
+		stats.Removed += removed
+	}
+	return stats, nil
+}
+
+func (mbd *mysqlBackend) compactDocument(ctx context.Context, uid uuid.UUID, policies []RetentionPolicy, now time.Time) (int, error) {
+	// most documents have nothing to compact, so they are checked without
+	// writing to them first
+	if compacted, err := compactable(ctx, mbd.db, uid, policies, now); err != nil || len(compacted) == 0 {
+		return 0, err
+	}
+	// compaction rewrites history, so it is validated against batches that
+	// edit the document concurrently like any other write
+	removed := 0
+	_, err := mbd.writeTx(ctx, []uuid.UUID{uid}, func(tx *sql.Tx, timestamp time.Time) error {
+		compacted, err := compactable(ctx, tx, uid, policies, now)
+		if err != nil || len(compacted) == 0 {
+			return err
+		}
+		earliest := compacted[0].time
+		for _, row := range compacted {
+			if _, err = tx.ExecContext(ctx, compactDeleteTemplate, uid.String(), row.key, row.time, row.val); err != nil {
+				return err
+			}
+			if row.time.Before(earliest) {
+				earliest = row.time
+			}
+		}
+		if err = rebuildCurrentDocument(ctx, tx, uid); err != nil {
+			return err
+		}
+		if err = invalidateCheckpoints(ctx, tx, uid, earliest); err != nil {
+			return err
+		}
+		removed = len(compacted)
+		return mbd.maybeCheckpoint(ctx, tx, uid)
+	})
+	return removed, err
+}
+
+// Returns the rows of the document's history that the policies remove
+func compactable(ctx context.Context, db queryer, uid uuid.UUID, policies []RetentionPolicy, now time.Time) ([]compactRow, error) {
+	rows, err := db.QueryContext(ctx, compactHistoryTemplate, uid.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var history []compactRow
+	for rows.Next() {
+		var row compactRow
+		if err = rows.Scan(&row.key, &row.val, &row.time); err != nil {
+			return nil, err
+		}
+		history = append(history, row)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return compactRows(history, policies, now), nil
+}
+
+// Compacts the database every interval until the process exits
+func (mbd *mysqlBackend) StartCompactor(policies []RetentionPolicy, interval time.Duration) {
+	for range time.Tick(interval) {
+		start := time.Now()
+		stats, err := mbd.Compact(context.Background(), policies, start)
+		if err != nil {
+			log.Printf("Compaction failed: %v", err)
+			continue
+		}
+		log.Printf("Compacted %d documents in %v, removing %d edits", stats.Documents, time.Since(start), stats.Removed)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	policies, err := parseRetention("Location/*=0, Status/*=90d,Status/Battery=36h")
+	if err != nil {
+		t.Fatalf("Could not parse retention: %v", err)
+	}
+	expected := []RetentionPolicy{
+		{"Location/", 0},
+		{"Status/", 90 * 24 * time.Hour},
+		{"Status/Battery", 36 * time.Hour},
+	}
+	if !reflect.DeepEqual(policies, expected) {
+		t.Errorf("Got %v but wanted %v", policies, expected)
+	}
+	for _, s := range []string{"Status/*", "Status/*=soon"} {
+		if _, err := parseRetention(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+
+	for key, keep := range map[string]time.Duration{
+		"Location/Room":  0,
+		"Status/Door":    90 * 24 * time.Hour,
+		"Status/Battery": 36 * time.Hour,
+		"Other":          0,
+	} {
+		if got := retentionFor(expected, key); got != keep {
+			t.Errorf("Got retention %v for %s but wanted %v", got, key, keep)
+		}
+	}
+}
+
+func TestCompactRows(t *testing.T) {
+	value := func(s string) sql.NullString { return sql.NullString{String: s, Valid: true} }
+	removed := sql.NullString{}
+	at := func(sec int64) time.Time { return time.Unix(sec, 0).UTC() }
+	rows := []compactRow{
+		{"Location/Room", value("a"), at(1)},
+		{"Location/Room", value("a"), at(2)},
+		{"Location/Room", value("b"), at(3)},
+		{"Status/Door", removed, at(1)},
+		{"Status/Door", value("open"), at(2)},
+		{"Status/Door", value("shut"), at(3)},
+		{"Status/Door", value("shut"), at(4)},
+		{"Status/Door", value("open"), at(5)},
+		{"Status/Door", value("shut"), at(20)},
+		{"Status/Light", value("on"), at(2)},
+		{"Status/Light", removed, at(5)},
+		{"Status/Light", value("on"), at(15)},
+	}
+	policies := []RetentionPolicy{{"Status/", 10 * time.Second}}
+
+	got := compactRows(rows, policies, at(20))
+	expected := []compactRow{
+		// duplicates are coalesced regardless of retention
+		{"Location/Room", value("a"), at(2)},
+		{"Status/Door", removed, at(1)},
+		{"Status/Door", value("shut"), at(4)},
+		// only the last edit before the cutoff at 10 is kept
+		{"Status/Door", value("open"), at(2)},
+		{"Status/Door", value("shut"), at(3)},
+		{"Status/Light", value("on"), at(2)},
+		// and only if it did not remove the key
+		{"Status/Light", removed, at(5)},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got %v but wanted %v", got, expected)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	backend.checkpointEdits = 10
+	ctx := context.Background()
+	uid, _ := uuid.FromString("e1c2d3e4-8cbd-11e5-8bb3-0cc47a0f7eea")
+	defer removeDocument(backend, uid)
+
+	for i := 0; i < 100; i++ {
+		tags := map[string]string{
+			"Compact/Location": fmt.Sprintf("room%d", i/10),
+			"Compact/Status":   fmt.Sprintf("status%d", i%4),
+		}
+		if i%9 == 0 {
+			tags["Compact/Status"] = ""
+		}
+		doc := &Document{UUID: uid, Tags: tags}
+		if _, err := backend.InsertWithTimestamp(doc, time.Unix(int64(5000+i), 0), true); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	var (
+		now    = time.Unix(5100, 0)
+		window = now.Add(-30 * time.Second)
+		before = map[int64]map[string]string{}
+	)
+	for sec := int64(4999); sec <= 5100; sec++ {
+		doc, err := backend.DocumentAt(ctx, uid, time.Unix(sec, 0))
+		if err != nil {
+			t.Fatalf("DocumentAt failed: %v", err)
+		}
+		before[sec] = doc.Tags
+	}
+
+	policies := []RetentionPolicy{{"Compact/Status", 30 * time.Second}}
+	stats, err := backend.Compact(ctx, policies, now)
+	if err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if stats.Removed == 0 {
+		t.Errorf("Expected compaction to remove edits")
+	}
+	var remaining int
+	backend.db.QueryRow("SELECT COUNT(*) FROM data WHERE uuid = ?;", uid.String()).Scan(&remaining)
+	// ten locations, and the status edits within the window plus the last
+	// one before it
+	if remaining > 10+31 {
+		t.Errorf("Expected at most %d edits after compaction but got %d", 10+31, remaining)
+	}
+
+	for sec := int64(4999); sec <= 5100; sec++ {
+		at := time.Unix(sec, 0)
+		doc, err := backend.DocumentAt(ctx, uid, at)
+		if err != nil {
+			t.Fatalf("DocumentAt failed: %v", err)
+		}
+		if doc.Tags["Compact/Location"] != before[sec]["Compact/Location"] {
+			t.Errorf("Location at %v changed from %q to %q", at, before[sec]["Compact/Location"], doc.Tags["Compact/Location"])
+		}
+		if !at.Before(window) && doc.Tags["Compact/Status"] != before[sec]["Compact/Status"] {
+			t.Errorf("Status at %v changed from %q to %q", at, before[sec]["Compact/Status"], doc.Tags["Compact/Status"])
+		}
+	}
+	current, err := backend.CurrentDocument(ctx, uid)
+	if err != nil {
+		t.Fatalf("CurrentDocument failed: %v", err)
+	}
+	if !reflect.DeepEqual(current.Tags, before[5100]) {
+		t.Errorf("Current document changed from %v to %v", before[5100], current.Tags)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	query "./lang"
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The current table holds the latest row of data for each (uuid, dkey),
+// including removed keys (whose dval is NULL). It is updated in the same
+// transaction as every insert into data, so queries about the current
+// version of documents do not have to find the latest row of each key from
+// the whole history
+var currentCreate = `
+CREATE TABLE IF NOT EXISTS current
+(
+    uuid CHAR(37) NOT NULL,
+    dkey VARCHAR(128) NOT NULL,
+    dval VARCHAR(128) NULL,
+    timestamp TIMESTAMP(6) NOT NULL,
+    PRIMARY KEY (uuid, dkey),
+    INDEX current_dkey_dval (dkey, dval)
+);
+`
+
+// Applied to rows of current that already exist. An edit only replaces the
+// current value if it is at least as recent, so edits can be applied in any
+// order. MySQL evaluates the assignments from left to right, so dval must be
+// assigned before timestamp. The columns are qualified since the rebuild
+// selects columns with the same names
+var currentUpsert = `
+ON DUPLICATE KEY UPDATE
+    current.dval = IF(VALUES(timestamp) >= current.timestamp, VALUES(dval), current.dval),
+    current.timestamp = GREATEST(current.timestamp, VALUES(timestamp))`
+
+// Inserts the latest row of each (uuid, dkey) of data into current. %s is
+// an optional filter on the rows of data
+var currentRebuildTemplate = `
+INSERT INTO current (uuid, dkey, dval, timestamp)
+SELECT uuid, dkey, dval, timestamp
+FROM (
+    SELECT data.uuid, data.dkey, data.dval, data.timestamp
+    FROM data
+    INNER JOIN
+    (
+        SELECT uuid, dkey, MAX(timestamp) AS maxtime FROM data %s GROUP BY uuid, dkey
+    ) latest
+    ON data.uuid = latest.uuid AND data.dkey = latest.dkey AND data.timestamp = latest.maxtime
+) AS latest_rows
+` + currentUpsert + ";"
+
+var currentRebuild = fmt.Sprintf(currentRebuildTemplate, "")
+
+var currentRebuildDocument = fmt.Sprintf(currentRebuildTemplate, "WHERE uuid = ?")
+
+var currentDocumentTemplate = `
+select uuid, dkey, dval, timestamp from current
+where uuid = ? and dval is not null;
+`
+
+// Recomputes the current table from the history in data
+func (mbd *mysqlBackend) RebuildCurrent(ctx context.Context) error {
+	return mbd.inTx(ctx, func(tx *sql.Tx) error {
+		return rebuildCurrent(ctx, tx)
+	})
+}
+
+func rebuildCurrent(ctx context.Context, db queryer) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM current;"); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, currentRebuild)
+	return err
+}
+
+// Recomputes the rows of current for one document
+func rebuildCurrentDocument(ctx context.Context, db queryer, uid uuid.UUID) error {
+	if _, err := db.ExecContext(ctx, "DELETE FROM current WHERE uuid = ?;", uid.String()); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, currentRebuildDocument, uid.String())
+	return err
+}
+
+// Runs f inside a transaction, which is committed if f succeeds and rolled
+// back otherwise
+func (mbd *mysqlBackend) inTx(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := mbd.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// the value of each of the given keys of a document in effect at a time, and
+// when it was set
+var valuesAtTemplate = `
+select data.dkey, data.dval, data.timestamp from data
+inner join
+(
+    select dkey, max(timestamp) as maxtime from data
+    where uuid = ? and timestamp <= ? and dkey in (%s)
+    group by dkey
+) latest
+on data.dkey = latest.dkey and data.timestamp = latest.maxtime
+where data.uuid = ?;
+`
+
+// the latest edit to a key at or before some time
+type valueAt struct {
+	val  sql.NullString
+	time time.Time
+}
+
+// Returns the latest edit at or before the given time to each of the
+// document's keys that has one
+func valuesAt(ctx context.Context, db queryer, doc *Document, timestamp time.Time) (map[string]valueAt, error) {
+	var (
+		args         = []interface{}{doc.UUID.String(), timestamp}
+		placeholders = make([]string, 0, len(doc.Tags))
+		existing     = map[string]valueAt{}
+	)
+	for key := range doc.Tags {
+		args = append(args, key)
+		placeholders = append(placeholders, "?")
+	}
+	args = append(args, doc.UUID.String())
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(valuesAtTemplate, strings.Join(placeholders, ", ")), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			dkey  string
+			value valueAt
+		)
+		if err = rows.Scan(&dkey, &value.val, &value.time); err != nil {
+			return nil, err
+		}
+		existing[dkey] = value
+	}
+	return existing, rows.Err()
+}
+
+// Inserts the document's tags into data at the given time, replacing any
+// edits to the same keys at that time, and applies them to current. Unless
+// force is true, only the tags that change their keys are written. Returns
+// the sorted keys that were written and the replaced edits that had different
+// values. The caller is responsible for the document's checkpoints (see
+// Batch.Commit)
+func insertAt(ctx context.Context, db queryer, doc *Document, timestamp time.Time, force bool) ([]string, []Conflict, error) {
+	if !force && len(doc.Tags) > 0 {
+		var err error
+		if doc, err = changedTags(ctx, db, doc, timestamp); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(doc.Tags) == 0 {
+		return nil, nil, nil
+	}
+	conflicts, err := replaceEdits(ctx, db, doc, timestamp)
+	if err != nil {
+		return nil, nil, err
+	}
+	literal := query.SQLTime(timestamp)
+	stmt, args := doc.generateInsert("data", literal, "")
+	if _, err = db.ExecContext(ctx, stmt, args...); err != nil {
+		return nil, nil, err
+	}
+	stmt, args = doc.generateInsert("current", literal, currentUpsert)
+	if _, err = db.ExecContext(ctx, stmt, args...); err != nil {
+		return nil, nil, err
+	}
+	keys := make([]string, 0, len(doc.Tags))
+	for key := range doc.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, conflicts, nil
+}
+
+// Returns a copy of the document with only the tags that change the value of
+// their key at the given time. Setting a key to the value it already has and
+// removing a key that is not set are no-ops; they would only add identical
+// rows to the history
+func changedTags(ctx context.Context, db queryer, doc *Document, timestamp time.Time) (*Document, error) {
+	existing, err := valuesAt(ctx, db, doc, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	changed := &Document{UUID: doc.UUID, Tags: map[string]string{}}
+	for key, val := range doc.Tags {
+		// removed keys are stored as NULL
+		old := existing[key].val
+		if (val == "" && !old.Valid) || (old.Valid && old.String == val) {
+			continue
+		}
+		changed.Tags[key] = val
+	}
+	return changed, nil
+}
+
+// Returns the edit that ends an interval-valued fact at until: the value each
+// of the document's keys would have then without the fact, which is removed
+// if the key would not be set. Keys that are already edited at until are left
+// out, since that edit ends the fact. Must be called before the fact is
+// inserted
+func revertTags(ctx context.Context, db queryer, doc *Document, until time.Time) (*Document, error) {
+	existing, err := valuesAt(ctx, db, doc, until)
+	if err != nil {
+		return nil, err
+	}
+	revert := &Document{UUID: doc.UUID, Tags: map[string]string{}}
+	for key := range doc.Tags {
+		old, found := existing[key]
+		if found && old.time.Equal(until) {
+			continue
+		}
+		// an empty value removes the key
+		revert.Tags[key] = old.val.String
+	}
+	return revert, nil
+}
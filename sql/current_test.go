@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"github.com/satori/go.uuid"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCurrentDocument(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	uuid5, _ := uuid.FromString("411ce89c-8cbd-11e5-8bb3-0cc47a0f7eea")
+	uuidmissing, _ := uuid.FromString("cf8a4b2e-8cbd-11e5-8bb3-0cc47a0f7eea")
+
+	doc, err := backend.CurrentDocument(context.Background(), uuid5)
+	if err != nil {
+		t.Fatalf("CurrentDocument failed: %v", err)
+	}
+	if doc.Tags["Location/Room"] != "405" {
+		t.Errorf("Expected Location/Room 405 but got %v", doc.Tags["Location/Room"])
+	}
+	if _, found := doc.Tags["Metadata/Exposure"]; found {
+		t.Errorf("Removed key Metadata/Exposure still in document %v", doc.Tags)
+	}
+
+	doc, err = backend.CurrentDocument(context.Background(), uuidmissing)
+	if err != nil {
+		t.Fatalf("CurrentDocument failed: %v", err)
+	}
+	if len(doc.Tags) != 0 {
+		t.Errorf("Expected no tags for unknown document but got %v", doc.Tags)
+	}
+}
+
+func TestCurrentTable(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	ctx := context.Background()
+	uid, _ := uuid.FromString("e3b1c6a4-8cbd-11e5-8bb3-0cc47a0f7eea")
+	defer removeDocument(backend, uid)
+
+	for _, edit := range []struct {
+		tags map[string]string
+		time int64
+	}{
+		{map[string]string{"Test/A": "new", "Test/B": "kept"}, 200},
+		// older edits must not replace the current value
+		{map[string]string{"Test/A": "old"}, 100},
+		{map[string]string{"Test/B": ""}, 300},
+	} {
+		if _, err := backend.InsertWithTimestamp(&Document{UUID: uid, Tags: edit.tags}, time.Unix(edit.time, 0), false); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	doc, err := backend.CurrentDocument(ctx, uid)
+	if err != nil {
+		t.Fatalf("CurrentDocument failed: %v", err)
+	}
+	if !reflect.DeepEqual(doc.Tags, map[string]string{"Test/A": "new"}) {
+		t.Errorf("Expected current tags {Test/A: new} but got %v", doc.Tags)
+	}
+
+	// the current table must match what is recomputed from history
+	var before, after int
+	if err = backend.db.QueryRow("SELECT COUNT(*) FROM current;").Scan(&before); err != nil {
+		t.Fatalf("Could not count current rows: %v", err)
+	}
+	if err = backend.RebuildCurrent(ctx); err != nil {
+		t.Fatalf("RebuildCurrent failed: %v", err)
+	}
+	if err = backend.db.QueryRow("SELECT COUNT(*) FROM current;").Scan(&after); err != nil {
+		t.Fatalf("Could not count current rows: %v", err)
+	}
+	if before != after {
+		t.Errorf("Expected %d current rows after rebuilding but got %d", before, after)
+	}
+	rebuilt, err := backend.CurrentDocument(ctx, uid)
+	if err != nil {
+		t.Fatalf("CurrentDocument failed: %v", err)
+	}
+	if !reflect.DeepEqual(doc.Tags, rebuilt.Tags) {
+		t.Errorf("Expected %v after rebuilding but got %v", doc.Tags, rebuilt.Tags)
+	}
+}
+
+func TestIntervalFacts(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	ctx := context.Background()
+	uid, _ := uuid.FromString("e5f6a7b8-8cbd-11e5-8bb3-0cc47a0f7eea")
+	defer removeDocument(backend, uid)
+	for _, edit := range []struct {
+		key  string
+		val  string
+		time int64
+	}{{"Test/Calibration", "1.0", 100}, {"Test/Calibration", "2.0", 250}} {
+		doc := &Document{UUID: uid, Tags: map[string]string{edit.key: edit.val}}
+		if _, err := backend.InsertWithTimestamp(doc, time.Unix(edit.time, 0), false); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+	doc := &Document{UUID: uid, Tags: map[string]string{"Test/Calibration": "1.5", "Test/Maintenance": "on"}}
+	changed, err := backend.InsertInterval(doc, time.Unix(200, 0), time.Unix(300, 0), false)
+	if err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if !reflect.DeepEqual(changed, []string{"Test/Calibration", "Test/Maintenance"}) {
+		t.Errorf("Got changed keys %v", changed)
+	}
+	if _, err = backend.InsertInterval(doc, time.Unix(300, 0), time.Unix(200, 0), false); err == nil {
+		t.Errorf("Expected an error for an interval that ends before it starts")
+	}
+
+	for _, test := range []struct {
+		at   int64
+		tags map[string]string
+	}{
+		{150, map[string]string{"Test/Calibration": "1.0"}},
+		{200, map[string]string{"Test/Calibration": "1.5", "Test/Maintenance": "on"}},
+		// the edit at 250 still replaces the value within the interval
+		{260, map[string]string{"Test/Calibration": "2.0", "Test/Maintenance": "on"}},
+		// and is what the value reverts to, while the flag is removed
+		{300, map[string]string{"Test/Calibration": "2.0"}},
+	} {
+		got, err := backend.DocumentAt(ctx, uid, time.Unix(test.at, 0))
+		if err != nil {
+			t.Fatalf("DocumentAt failed: %v", err)
+		}
+		if !reflect.DeepEqual(got.Tags, test.tags) {
+			t.Errorf("Got %v at %d but wanted %v", got.Tags, test.at, test.tags)
+		}
+	}
+
+	// temporal operators see the end of the interval
+	for querystring, matches := range map[string]bool{
+		`select * where Test/Maintenance = "on" at 220;`:                         true,
+		`select * where Test/Maintenance = "on" at 320;`:                         false,
+		`select * where Test/Maintenance = "on";`:                                false,
+		`select * where Test/Maintenance = "on" for at least 100s in (0, 1000);`: true,
+		`select * where Test/Maintenance = "on" for at least 101s in (0, 1000);`: false,
+	} {
+		q, err := backend.Parse(querystring)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		docs, err := backend.Eval(ctx, q)
+		if err != nil {
+			t.Fatalf("Eval failed: %v", err)
+		}
+		if found := len(docs) == 1 && docs[0].UUID == uid; found != matches {
+			t.Errorf("Query %v: got match %v but wanted %v", querystring, found, matches)
+		}
+	}
+}
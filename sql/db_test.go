@@ -72,7 +72,7 @@ func TestMain(m *testing.M) {
 		Document{UUID: uuid5, Tags: map[string]string{"Metadata/Exposure": ""}}, // 19
 	} {
 		// generate stricly ordered times so that we can write tests easily
-		if err := backend.InsertWithTimestamp(&doc, time.Unix(int64(i)+1, 0)); err != nil {
+		if _, err := backend.InsertWithTimestamp(&doc, time.Unix(int64(i)+1, 0), false); err != nil {
 			log.Fatal("Error inserting: %v", err)
 		}
 	}
@@ -101,7 +101,7 @@ func TestInsert(t *testing.T) {
 			true,
 		},
 	} {
-		if err := backend.Insert(&test.doc); test.ok != (err == nil) {
+		if _, err := backend.Insert(&test.doc, false); test.ok != (err == nil) {
 			t.Errorf("Insert test failed: Expected err? %v Err: %v", test.ok, err)
 		}
 	}
@@ -140,7 +140,7 @@ func TestRecentDocument(t *testing.T) {
 					"Metadata/Point/Sensor":    "Temperature",
 					"Metadata/Exposure":        "South",
 				},
-				ValidTime: MustParse(time.RFC3339, "1969-12-31T16:00:14Z"),
+				ValidTime: MustParse(time.RFC3339, "1970-01-01T00:00:14Z"),
 			},
 		},
 		{
@@ -160,7 +160,7 @@ func TestRecentDocument(t *testing.T) {
 					"Metadata/Point/Sensor":    "Temperature",
 					"Metadata/Exposure":        "West",
 				},
-				ValidTime: MustParse(time.RFC3339, "1969-12-31T16:00:15Z"),
+				ValidTime: MustParse(time.RFC3339, "1970-01-01T00:00:15Z"),
 			},
 		},
 		{
@@ -180,7 +180,7 @@ func TestRecentDocument(t *testing.T) {
 					"Metadata/Point/Sensor":    "Temperature",
 					"Metadata/Exposure":        "North",
 				},
-				ValidTime: MustParse(time.RFC3339, "1969-12-31T16:00:16Z"),
+				ValidTime: MustParse(time.RFC3339, "1970-01-01T00:00:16Z"),
 			},
 		},
 		{
@@ -200,7 +200,7 @@ func TestRecentDocument(t *testing.T) {
 					"Metadata/Point/Sensor":    "Temperature",
 					"Metadata/Exposure":        "East",
 				},
-				ValidTime: MustParse(time.RFC3339, "1969-12-31T16:00:17Z"),
+				ValidTime: MustParse(time.RFC3339, "1970-01-01T00:00:17Z"),
 			},
 		},
 		{
@@ -219,7 +219,7 @@ func TestRecentDocument(t *testing.T) {
 					"Metadata/Point/Type":      "Sensor",
 					"Metadata/Point/Sensor":    "Temperature",
 				},
-				ValidTime: MustParse(time.RFC3339, "1969-12-31T16:00:19Z"),
+				ValidTime: MustParse(time.RFC3339, "1970-01-01T00:00:19Z"),
 				//TODO: bug here. The test currently returns time 13, rather than 19. This is because it retrieves
 				// the earliest version of the document equivalent to its latest form. Because it doesn't have an Exposure
 				// tag at 19, it looks for the earliset time that it does, which is 13
@@ -0,0 +1,184 @@
+package main
+
+import (
+	query "./lang"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A key whose value differs between two versions of a document
+type KeyDiff struct {
+	Key string `json:"key"`
+	// empty if the key was added
+	Old string `json:"old,omitempty"`
+	// empty if the key was removed
+	New string `json:"new,omitempty"`
+	// when the old value was set; nil for added keys
+	OldTime *time.Time `json:"old_time,omitempty"`
+	// when the new value was set, or the key removed; nil if unknown
+	NewTime *time.Time `json:"new_time,omitempty"`
+}
+
+// The changes between two versions of a document. Each list is sorted by key
+type DocumentDiff struct {
+	UUID    uuid.UUID `json:"uuid"`
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Added   []KeyDiff `json:"added"`
+	Removed []KeyDiff `json:"removed"`
+	Changed []KeyDiff `json:"changed"`
+}
+
+// Returns true if the two versions have the same tags
+func (diff *DocumentDiff) Empty() bool {
+	return len(diff.Added) == 0 && len(diff.Removed) == 0 && len(diff.Changed) == 0
+}
+
+func (diff *DocumentDiff) PrettyString() string {
+	if b, err := json.MarshalIndent(diff, "", "  "); err != nil {
+		return fmt.Sprintf("ERROR FORMATTING (%v) %v", err, diff)
+	} else {
+		return string(b)
+	}
+}
+
+// Returns the changes that turn doc into other, which is usually a later
+// version of the same document. The document's tag times give the edit times
+// of the values; the time at which a key was removed is not part of a
+// document, so the NewTime of removed keys is nil
+func (doc *Document) Diff(other *Document) *DocumentDiff {
+	diff := &DocumentDiff{UUID: doc.UUID, From: doc.ValidTime, To: other.ValidTime, Added: []KeyDiff{}, Removed: []KeyDiff{}, Changed: []KeyDiff{}}
+	for key, old := range doc.Tags {
+		change := KeyDiff{Key: key, Old: old, OldTime: tagTime(doc, key)}
+		if val, found := other.Tags[key]; !found {
+			diff.Removed = append(diff.Removed, change)
+		} else if val != old {
+			change.New = val
+			change.NewTime = tagTime(other, key)
+			diff.Changed = append(diff.Changed, change)
+		}
+	}
+	for key, val := range other.Tags {
+		if _, found := doc.Tags[key]; !found {
+			diff.Added = append(diff.Added, KeyDiff{Key: key, New: val, NewTime: tagTime(other, key)})
+		}
+	}
+	for _, changes := range [][]KeyDiff{diff.Added, diff.Removed, diff.Changed} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	}
+	return diff
+}
+
+// returns the time the key was set, or nil if the document does not know it
+func tagTime(doc *Document, key string) *time.Time {
+	if t, found := doc.TagTimes[key]; found {
+		return &t
+	}
+	return nil
+}
+
+// the time each of the given keys of a document was last edited in a range
+var removalTimesTemplate = `
+select dkey, max(timestamp) from data
+where uuid = ? and timestamp > ? and timestamp <= ? and dkey in (%s)
+group by dkey;
+`
+
+// Returns the changes to the document with the given UUID between the two
+// times (see Document.Diff). A zero from compares against the empty document,
+// and a zero to against the most recent version. Unlike Document.Diff, the
+// times at which keys were removed are filled in from the history. It is
+// cancelled when ctx is done or the query timeout passes
+func (mbd *mysqlBackend) DiffAt(ctx context.Context, uid uuid.UUID, from, to time.Time) (*DocumentDiff, error) {
+	ctx, cancel := mbd.withTimeout(ctx)
+	defer cancel()
+	diff, err := mbd.diffAt(ctx, mbd.db, uid, from, to)
+	return diff, contextError(ctx, err)
+}
+
+func (mbd *mysqlBackend) diffAt(ctx context.Context, db queryer, uid uuid.UUID, from, to time.Time) (*DocumentDiff, error) {
+	end := to
+	if end == ZERO_TIME {
+		end = MAX_TIME
+	}
+	before, err := mbd.documentAt(ctx, db, uid, from, true)
+	if err != nil {
+		return nil, err
+	}
+	after, err := mbd.documentAt(ctx, db, uid, end, true)
+	if err != nil {
+		return nil, err
+	}
+	if to == ZERO_TIME {
+		after.setValidTime(ZERO_TIME)
+	}
+	diff := before.Diff(after)
+	if len(diff.Removed) == 0 {
+		return diff, nil
+	}
+
+	var (
+		args         = []interface{}{uid.String(), from, end}
+		placeholders = make([]string, 0, len(diff.Removed))
+		removed      = map[string]int{}
+	)
+	for idx, change := range diff.Removed {
+		args = append(args, change.Key)
+		placeholders = append(placeholders, "?")
+		removed[change.Key] = idx
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(removalTimesTemplate, strings.Join(placeholders, ", ")), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			dkey  string
+			dtime time.Time
+		)
+		if err = rows.Scan(&dkey, &dtime); err != nil {
+			return nil, err
+		}
+		diff.Removed[removed[dkey]].NewTime = &dtime
+	}
+	return diff, rows.Err()
+}
+
+// Evaluates a query with a diff(t0, t1) select term, returning the changes
+// between the two times to each document that matches the WHERE clause.
+// Documents that did not change are left out
+func (mbd *mysqlBackend) EvalDiff(ctx context.Context, q *query.Query) ([]*DocumentDiff, error) {
+	ctx, cancel := mbd.withTimeout(ctx)
+	defer cancel()
+	return mbd.evalDiff(ctx, mbd.db, q)
+}
+
+func (mbd *mysqlBackend) evalDiff(ctx context.Context, db queryer, q *query.Query) ([]*DocumentDiff, error) {
+	term, found := q.Diff()
+	if !found {
+		return nil, fmt.Errorf("Query has no diff term")
+	}
+	// the matching documents are read before diffing them, since db may be a
+	// transaction
+	docs, err := mbd.eval(ctx, db, q)
+	if err != nil {
+		return nil, err
+	}
+	diffs := []*DocumentDiff{}
+	for _, doc := range docs {
+		diff, err := mbd.diffAt(ctx, db, doc.UUID, term.StartTime, term.EndTime)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+		if !diff.Empty() {
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"github.com/satori/go.uuid"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDocumentDiff(t *testing.T) {
+	uid, _ := uuid.FromString("aa45f708-8be8-11e5-86ae-5cc5d4ded1ae")
+	at := func(sec int64) time.Time { return time.Unix(sec, 0).UTC() }
+	ptr := func(t time.Time) *time.Time { return &t }
+	before := &Document{
+		UUID:      uid,
+		Tags:      map[string]string{"Location/Room": "410", "Location/Floor": "4", "Metadata/Exposure": "South"},
+		TagTimes:  map[string]time.Time{"Location/Room": at(1), "Location/Floor": at(1), "Metadata/Exposure": at(2)},
+		ValidTime: at(10),
+	}
+	after := &Document{
+		UUID:      uid,
+		Tags:      map[string]string{"Location/Room": "411", "Location/Floor": "4", "Metadata/Point/Type": "Sensor"},
+		TagTimes:  map[string]time.Time{"Location/Room": at(12), "Location/Floor": at(1), "Metadata/Point/Type": at(15)},
+		ValidTime: at(20),
+	}
+
+	expected := &DocumentDiff{
+		UUID:    uid,
+		From:    at(10),
+		To:      at(20),
+		Added:   []KeyDiff{{Key: "Metadata/Point/Type", New: "Sensor", NewTime: ptr(at(15))}},
+		Removed: []KeyDiff{{Key: "Metadata/Exposure", Old: "South", OldTime: ptr(at(2))}},
+		Changed: []KeyDiff{{Key: "Location/Room", Old: "410", New: "411", OldTime: ptr(at(1)), NewTime: ptr(at(12))}},
+	}
+	if diff := before.Diff(after); !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Got diff\n%v\nbut wanted\n%v", diff.PrettyString(), expected.PrettyString())
+	}
+	if diff := before.Diff(before); !diff.Empty() {
+		t.Errorf("Expected no changes between a document and itself but got\n%v", diff.PrettyString())
+	}
+}
+
+func TestDiffAt(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	ctx := context.Background()
+	uid, _ := uuid.FromString("e7a8b9c0-8cbd-11e5-8bb3-0cc47a0f7eea")
+	defer removeDocument(backend, uid)
+
+	for _, edit := range []struct {
+		tags map[string]string
+		time int64
+	}{
+		{map[string]string{"Test/Room": "410", "Test/Floor": "4", "Test/Exposure": "South"}, 100},
+		{map[string]string{"Test/Room": "411"}, 200},
+		{map[string]string{"Test/Exposure": "", "Test/Type": "Sensor"}, 300},
+		// changed and changed back within the range
+		{map[string]string{"Test/Floor": "5"}, 350},
+		{map[string]string{"Test/Floor": "4"}, 360},
+	} {
+		if _, err := backend.InsertWithTimestamp(&Document{UUID: uid, Tags: edit.tags}, time.Unix(edit.time, 0), false); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	diff, err := backend.DiffAt(ctx, uid, time.Unix(150, 0), time.Unix(400, 0))
+	if err != nil {
+		t.Fatalf("DiffAt failed: %v", err)
+	}
+	keys := func(changes []KeyDiff) []string {
+		ret := []string{}
+		for _, change := range changes {
+			ret = append(ret, change.Key)
+		}
+		return ret
+	}
+	if got := keys(diff.Added); !reflect.DeepEqual(got, []string{"Test/Type"}) {
+		t.Errorf("Expected Test/Type to be added but got %v", got)
+	}
+	if got := keys(diff.Changed); !reflect.DeepEqual(got, []string{"Test/Room"}) {
+		t.Errorf("Expected Test/Room to change but got %v", got)
+	} else if diff.Changed[0].Old != "410" || diff.Changed[0].New != "411" || !diff.Changed[0].NewTime.Equal(time.Unix(200, 0)) {
+		t.Errorf("Expected Test/Room to change from 410 to 411 at 200 but got %+v", diff.Changed[0])
+	}
+	if got := keys(diff.Removed); !reflect.DeepEqual(got, []string{"Test/Exposure"}) {
+		t.Errorf("Expected Test/Exposure to be removed but got %v", got)
+	} else if diff.Removed[0].NewTime == nil || !diff.Removed[0].NewTime.Equal(time.Unix(300, 0)) {
+		t.Errorf("Expected Test/Exposure to be removed at 300 but got %v", diff.Removed[0].NewTime)
+	}
+
+	// the same diff from a query, up to the current version
+	q, err := backend.Parse(`select diff(150, now) where Test/Room = "411";`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	diffs, err := backend.EvalDiff(ctx, q)
+	if err != nil {
+		t.Fatalf("EvalDiff failed: %v", err)
+	}
+	if len(diffs) != 1 || diffs[0].UUID != uid || !reflect.DeepEqual(diffs[0].Changed, diff.Changed) {
+		t.Errorf("Expected the diff of %v from the query but got %v", uid, diffs)
+	}
+}
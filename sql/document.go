@@ -2,22 +2,30 @@ package main
 
 import (
 	query "./lang"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"github.com/satori/go.uuid"
+	"strings"
 	"time"
 )
 
 type Document struct {
 	// the unique document identifier
-	UUID uuid.UUID
+	UUID uuid.UUID `json:"uuid"`
 	// Key->Value pairs this document contains
-	Tags map[string]string
+	Tags map[string]string `json:"tags"`
 	// When the keys were applied
-	TagTimes map[string]time.Time
+	TagTimes map[string]time.Time `json:"tag_times"`
 	// the time at which this document is valid (the max of the tag times)
-	ValidTime time.Time
+	ValidTime time.Time `json:"valid_time"`
+	// the changes matched by the changed(Key) terms of the query that
+	// returned this document, if any
+	Transitions []Transition `json:"transitions,omitempty"`
+	// the time each value was in effect, for the duration(Key) terms of the
+	// query that returned this document, if any
+	Durations []ValueDuration `json:"durations,omitempty"`
 }
 
 //type SelectTerm struct {
@@ -68,54 +76,60 @@ func (doc *Document) findLatestTag() string {
 	return ret
 }
 
-// Generates a batch INSERT statement. If ignoreTagTimes is true, then the tags are
-// applied at time "now" as determined by the MySQL database
-func (doc *Document) GenerateInsertStatement(ignoreTagTimes bool) string {
-	var s = "INSERT INTO data (uuid, dkey, dval) VALUES "
+// Generates a batch INSERT statement and its arguments. If ignoreTagTimes is
+// true, then the tags are applied at time "now" as determined by the MySQL
+// database
+func (doc *Document) GenerateInsertStatement(ignoreTagTimes bool) (string, []interface{}) {
+	if ignoreTagTimes {
+		return "INSERT INTO data (uuid, dkey, dval) VALUES " + placeholders(len(doc.Tags), "(?, ?, ?)") + ";", doc.GenerateValues()
+	}
+	var args []interface{}
 	for key, val := range doc.Tags {
-		if len(val) == 0 {
-			val = "NULL"
-		} else {
-			val = `"` + val + `"`
-		}
-		if ignoreTagTimes {
-			s += fmt.Sprintf(`("%s", "%s", %s),`, doc.UUID.String(), key, val)
-		} else {
-			s += fmt.Sprintf(`("%s", "%s", %s, "%s"),`, doc.UUID.String(), key, val, doc.TagTimes[key].Format(time.RFC3339))
-		}
+		args = append(args, doc.UUID.String(), key, nullable(val), query.SQLTime(doc.TagTimes[key]))
 	}
-	s = s[:len(s)-1]
-	return s + ";"
+	return "INSERT INTO data (uuid, dkey, dval, timestamp) VALUES " + placeholders(len(doc.Tags), "(?, ?, ?, ?)") + ";", args
+}
+
+func (doc *Document) GenerateInsertStatementWithTimestamp(timestamp time.Time) (string, []interface{}) {
+	return doc.generateInsert("data", query.SQLTime(timestamp), "")
 }
 
-func (doc *Document) GenerateInsertStatementWithTimestamp(timestamp time.Time) string {
-	var s = "INSERT INTO data (uuid, dkey, dval, timestamp) VALUES "
+// Generates an insert of the document's tags into the given table at the
+// given time (a MySQL datetime literal), followed by the given clause, and
+// its arguments
+func (doc *Document) generateInsert(table, timestamp, clause string) (string, []interface{}) {
+	var args []interface{}
 	for key, val := range doc.Tags {
-		if len(val) == 0 {
-			val = "NULL"
-		} else {
-			val = `"` + val + `"`
-		}
-		s += fmt.Sprintf(`("%s", "%s", %s, "%s"),`, doc.UUID.String(), key, val, timestamp.Format(time.RFC3339))
+		args = append(args, doc.UUID.String(), key, nullable(val), timestamp)
 	}
-	s = s[:len(s)-1]
-	return s + ";"
+	return "INSERT INTO " + table + " (uuid, dkey, dval, timestamp) VALUES " + placeholders(len(doc.Tags), "(?, ?, ?, ?)") + clause + ";", args
 }
 
-// Generate the VALUES input ("uuid","key","val") for the purposes
-// of checking w/ unit tests. This is because we don't get guaranteed
-// iteration order w/ maps (our tags field)
-func (doc *Document) GenerateValues() []string {
-	var ret []string
+// Generate the arguments for the VALUES placeholders (uuid, key, val) of an
+// insert without timestamps. Removed tags are NULL
+func (doc *Document) GenerateValues() []interface{} {
+	var args []interface{}
 	for key, val := range doc.Tags {
-		if len(val) == 0 {
-			val = "NULL"
-		} else {
-			val = `"` + val + `"`
-		}
-		ret = append(ret, fmt.Sprintf(`("%s", "%s", %s)`, doc.UUID.String(), key, val))
+		args = append(args, doc.UUID.String(), key, nullable(val))
 	}
-	return ret
+	return args
+}
+
+// Returns n copies of the placeholder group separated by commas
+func placeholders(n int, group string) string {
+	groups := make([]string, n)
+	for i := range groups {
+		groups[i] = group
+	}
+	return strings.Join(groups, ", ")
+}
+
+// Returns the argument for a tag value: NULL for a removed tag
+func nullable(val string) interface{} {
+	if len(val) == 0 {
+		return nil
+	}
+	return val
 }
 
 // finds the most recent tag.Time from its list of tags
@@ -157,31 +171,156 @@ func DocsFromRows(rows *sql.Rows, now time.Time) ([]*Document, error) {
 		if err := rows.Scan(&duuid, &dkey, &dval, &dtime); err != nil {
 			return docs, err
 		}
-		if doc, found := uniqueDocs[duuid]; found {
-			if dval.Valid { // value can be null
-				doc.Tags[dkey] = dval.String
-			} // but we still want to keep track of the time
-			doc.TagTimes[dkey] = dtime
-		} else {
+		doc, found := uniqueDocs[duuid]
+		if !found {
 			parsedUUID, err := uuid.FromString(duuid)
 			if err != nil {
 				return docs, err
 			}
-			doc = &Document{UUID: parsedUUID, Tags: map[string]string{}, TagTimes: map[string]time.Time{dkey: dtime}}
-			if dval.Valid {
-				doc.Tags[dkey] = dval.String
-			}
+			doc = &Document{UUID: parsedUUID, Tags: map[string]string{}, TagTimes: map[string]time.Time{}}
 			uniqueDocs[duuid] = doc
 			docs = append(docs, doc)
 		}
+		doc.applyRow(dkey, dval, dtime)
 	}
 	// add in the valid times for all documents
 	for _, doc := range docs {
-		if now == ZERO_TIME {
-			doc.CalcMaxTagTime()
-		} else {
-			doc.ValidTime = now
-		}
+		doc.setValidTime(now)
 	}
 	return docs, nil
 }
+
+func (doc *Document) applyRow(dkey string, dval sql.NullString, dtime time.Time) {
+	if dval.Valid { // value can be null
+		doc.Tags[dkey] = dval.String
+	} // but we still want to keep track of the time
+	doc.TagTimes[dkey] = dtime
+}
+
+// Applies an edit on top of the document: unlike applyRow, a NULL value
+// removes the key. Edits must be replayed in timestamp order
+func (doc *Document) replayRow(dkey string, dval sql.NullString, dtime time.Time) {
+	if dval.Valid {
+		doc.Tags[dkey] = dval.String
+		doc.TagTimes[dkey] = dtime
+	} else {
+		delete(doc.Tags, dkey)
+		delete(doc.TagTimes, dkey)
+	}
+}
+
+func (doc *Document) setValidTime(now time.Time) {
+	if now == ZERO_TIME {
+		doc.CalcMaxTagTime()
+	} else {
+		doc.ValidTime = now
+	}
+}
+
+// Iterates over the documents in the results of a SQL query, yielding each
+// document as soon as all of its rows have been read, so that only one
+// document is held in memory at a time. Rows must be ordered by uuid
+type DocIterator struct {
+	rows *sql.Rows
+	now  time.Time
+	// the context of the query, used to report cancellation
+	ctx context.Context
+	// called once the rows are closed
+	release func()
+	// applied to each document before it is yielded
+	selects []query.SelectTerm
+	// the changes matched by the query's changed(Key) terms, by UUID
+	transitions map[string][]Transition
+	// the durations selected by the query's duration(Key) terms, by UUID
+	durations map[string][]ValueDuration
+	// the document returned by Document()
+	doc *Document
+	// the document whose first row has been read but which is not complete
+	next *Document
+	err  error
+}
+
+func NewDocIterator(rows *sql.Rows, now time.Time) *DocIterator {
+	return &DocIterator{rows: rows, now: now}
+}
+
+// Advances to the next complete document. Returns false when there are no
+// more documents or an error occured, which is then returned by Err
+func (it *DocIterator) Next() bool {
+	it.doc = nil
+	if it.err != nil || it.rows == nil {
+		return false
+	}
+	for it.rows.Next() {
+		var (
+			duuid string
+			dkey  string
+			dval  sql.NullString
+			dtime time.Time
+		)
+		if it.err = it.rows.Scan(&duuid, &dkey, &dval, &dtime); it.err != nil {
+			return false
+		}
+		if it.next == nil || it.next.UUID.String() != duuid {
+			parsedUUID, err := uuid.FromString(duuid)
+			if err != nil {
+				it.err = err
+				return false
+			}
+			done := it.next
+			it.next = &Document{UUID: parsedUUID, Tags: map[string]string{}, TagTimes: map[string]time.Time{}}
+			it.next.applyRow(dkey, dval, dtime)
+			if done != nil {
+				it.yield(done)
+				return true
+			}
+			continue
+		}
+		it.next.applyRow(dkey, dval, dtime)
+	}
+	if it.err = it.rows.Err(); it.err != nil {
+		return false
+	}
+	if it.next != nil {
+		it.yield(it.next)
+		it.next = nil
+		return true
+	}
+	return false
+}
+
+func (it *DocIterator) yield(doc *Document) {
+	doc.setValidTime(it.now)
+	doc.Transitions = it.transitions[doc.UUID.String()]
+	doc.Durations = it.durations[doc.UUID.String()]
+	if it.selects != nil {
+		doc.ApplySelect(it.selects)
+	}
+	it.doc = doc
+}
+
+// Returns the document the iterator is positioned at by Next
+func (it *DocIterator) Document() *Document {
+	return it.doc
+}
+
+// Returns the error that stopped iteration. Errors caused by the query being
+// cancelled or timing out are returned as a *query.QueryError
+func (it *DocIterator) Err() error {
+	if it.ctx != nil {
+		return contextError(it.ctx, it.err)
+	}
+	return it.err
+}
+
+func (it *DocIterator) Close() error {
+	if it.rows == nil {
+		return nil
+	}
+	err := it.rows.Close()
+	if it.release != nil {
+		it.release()
+		it.release = nil
+	}
+	return err
+}
@@ -1,38 +1,226 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"github.com/satori/go.uuid"
+	"os"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestGenerateDocumentInsert(t *testing.T) {
 	uuid, _ := uuid.FromString("aa45f708-8be8-11e5-86ae-5cc5d4ded1ae")
 	for _, test := range []struct {
 		doc    Document
-		values []string
+		values [][]interface{}
 	}{
 		{
 			Document{UUID: uuid, Tags: map[string]string{"key1": "val1", "key2": "val2"}},
-			[]string{`("aa45f708-8be8-11e5-86ae-5cc5d4ded1ae", "key1", "val1")`, `("aa45f708-8be8-11e5-86ae-5cc5d4ded1ae", "key2", "val2")`},
+			[][]interface{}{{"aa45f708-8be8-11e5-86ae-5cc5d4ded1ae", "key1", "val1"}, {"aa45f708-8be8-11e5-86ae-5cc5d4ded1ae", "key2", "val2"}},
 		},
 		{
 			Document{UUID: uuid, Tags: map[string]string{"key1": ""}},
-			[]string{`("aa45f708-8be8-11e5-86ae-5cc5d4ded1ae", "key1", NULL)`},
+			[][]interface{}{{"aa45f708-8be8-11e5-86ae-5cc5d4ded1ae", "key1", nil}},
+		},
+		{
+			// values are passed as arguments, never spliced into the statement
+			Document{UUID: uuid, Tags: map[string]string{"key1": `say "hi" \o/'); DROP TABLE data; --`}},
+			[][]interface{}{{"aa45f708-8be8-11e5-86ae-5cc5d4ded1ae", "key1", `say "hi" \o/'); DROP TABLE data; --`}},
 		},
 	} {
 		generatedValues := test.doc.GenerateValues()
-		var found bool
-		for _, gv := range generatedValues {
-			found = false
+		if len(generatedValues) != 3*len(test.values) {
+			t.Errorf("Got \n%v\nbut wanted\n%v\n", generatedValues, test.values)
+			continue
+		}
+		for idx := 0; idx < len(generatedValues); idx += 3 {
+			var found bool
 			for _, v := range test.values {
-				if gv == v {
+				if reflect.DeepEqual(generatedValues[idx:idx+3], v) {
 					found = true
 					break
 				}
 			}
 			if !found {
-				t.Errorf("Got \n%s\nbut wanted\n%s\n", generatedValues, test.values)
+				t.Errorf("Got \n%v\nbut wanted\n%v\n", generatedValues, test.values)
 			}
 		}
 	}
 }
+
+func TestGenerateInsertIntoTable(t *testing.T) {
+	uuid, _ := uuid.FromString("aa45f708-8be8-11e5-86ae-5cc5d4ded1ae")
+	doc := Document{UUID: uuid, Tags: map[string]string{"key1": ""}}
+	generated, args := doc.generateInsert("current", "2015-11-12 10:00:00.000000", currentUpsert)
+	expected := `INSERT INTO current (uuid, dkey, dval, timestamp) VALUES (?, ?, ?, ?)` + currentUpsert + ";"
+	if generated != expected {
+		t.Errorf("Got \n%s\nbut wanted\n%s\n", generated, expected)
+	}
+	if expectedArgs := []interface{}{"aa45f708-8be8-11e5-86ae-5cc5d4ded1ae", "key1", nil, "2015-11-12 10:00:00.000000"}; !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Got arguments %v but wanted %v", args, expectedArgs)
+	}
+}
+
+func TestGenerateInsertWithTimestamp(t *testing.T) {
+	uuid, _ := uuid.FromString("aa45f708-8be8-11e5-86ae-5cc5d4ded1ae")
+	doc := Document{UUID: uuid, Tags: map[string]string{"key1": "a"}}
+	generated, args := doc.GenerateInsertStatementWithTimestamp(time.Unix(1447366661, 123456789))
+	expected := `INSERT INTO data (uuid, dkey, dval, timestamp) VALUES (?, ?, ?, ?);`
+	if generated != expected {
+		t.Errorf("Got \n%s\nbut wanted\n%s\n", generated, expected)
+	}
+	if expectedArgs := []interface{}{"aa45f708-8be8-11e5-86ae-5cc5d4ded1ae", "key1", "a", "2015-11-12 22:17:41.123456"}; !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Got arguments %v but wanted %v", args, expectedArgs)
+	}
+	doc.TagTimes = map[string]time.Time{"key1": time.Unix(1447366661, 1000)}
+	generated, args = doc.GenerateInsertStatement(false)
+	if generated != expected {
+		t.Errorf("Got \n%s\nbut wanted\n%s\n", generated, expected)
+	}
+	if expectedArgs := []interface{}{"aa45f708-8be8-11e5-86ae-5cc5d4ded1ae", "key1", "a", "2015-11-12 22:17:41.000001"}; !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("Got arguments %v but wanted %v", args, expectedArgs)
+	}
+	doc.Tags["key2"] = ""
+	generated, _ = doc.GenerateInsertStatement(true)
+	if expected = `INSERT INTO data (uuid, dkey, dval) VALUES (?, ?, ?), (?, ?, ?);`; generated != expected {
+		t.Errorf("Got \n%s\nbut wanted\n%s\n", generated, expected)
+	}
+}
+
+func TestReplayRow(t *testing.T) {
+	uuid, _ := uuid.FromString("aa45f708-8be8-11e5-86ae-5cc5d4ded1ae")
+	doc := &Document{UUID: uuid, Tags: map[string]string{}, TagTimes: map[string]time.Time{}}
+	for i, row := range []struct {
+		key string
+		val sql.NullString
+	}{
+		{"key1", sql.NullString{String: "a", Valid: true}},
+		{"key2", sql.NullString{String: "b", Valid: true}},
+		{"key1", sql.NullString{}},
+		{"key2", sql.NullString{String: "c", Valid: true}},
+	} {
+		doc.replayRow(row.key, row.val, time.Unix(int64(i), 0))
+	}
+	if !reflect.DeepEqual(doc.Tags, map[string]string{"key2": "c"}) {
+		t.Errorf("Got tags %v but wanted {key2: c}", doc.Tags)
+	}
+	if !reflect.DeepEqual(doc.TagTimes, map[string]time.Time{"key2": time.Unix(3, 0)}) {
+		t.Errorf("Got tag times %v but wanted {key2: %v}", doc.TagTimes, time.Unix(3, 0))
+	}
+}
+
+func removeDocument(backend *mysqlBackend, uid uuid.UUID) {
+	for _, table := range []string{"data", "current", "checkpoints", "document_versions"} {
+		backend.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE uuid = ?;", table), uid.String())
+	}
+}
+
+func TestInsertSkipsUnchangedKeys(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	uid, _ := uuid.FromString("e5f6a7b8-8cbd-11e5-8bb3-0cc47a0f7eea")
+	defer removeDocument(backend, uid)
+
+	for _, test := range []struct {
+		tags    map[string]string
+		time    int64
+		force   bool
+		changed []string
+	}{
+		{map[string]string{"Test/A": "1", "Test/B": "2"}, 100, false, []string{"Test/A", "Test/B"}},
+		// republishing the same tags changes nothing
+		{map[string]string{"Test/A": "1", "Test/B": "2"}, 200, false, nil},
+		{map[string]string{"Test/A": "1", "Test/B": "3", "Test/C": ""}, 300, false, []string{"Test/B"}},
+		{map[string]string{"Test/A": "1"}, 400, true, []string{"Test/A"}},
+		// compared with the value at the time of the edit, not the latest
+		{map[string]string{"Test/B": "2"}, 250, false, nil},
+		{map[string]string{"Test/B": "3"}, 250, false, []string{"Test/B"}},
+	} {
+		changed, err := backend.InsertWithTimestamp(&Document{UUID: uid, Tags: test.tags}, time.Unix(test.time, 0), test.force)
+		if err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+		if !reflect.DeepEqual(changed, test.changed) {
+			t.Errorf("Inserting %v at %d: got changed keys %v but wanted %v", test.tags, test.time, changed, test.changed)
+		}
+	}
+	var rows int
+	if err := backend.db.QueryRow("SELECT COUNT(*) FROM data WHERE uuid = ?;", uid.String()).Scan(&rows); err != nil {
+		t.Fatalf("Could not count rows: %v", err)
+	}
+	if rows != 5 {
+		t.Errorf("Expected 5 rows of history but got %d", rows)
+	}
+}
+
+func TestSubSecondPrecision(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	ctx := context.Background()
+	uid, _ := uuid.FromString("f6a7b8c9-8cbd-11e5-8bb3-0cc47a0f7eea")
+	defer removeDocument(backend, uid)
+	// edits one microsecond apart, the last given to the nanosecond
+	base := time.Unix(1447366661, 123456000).UTC()
+	for idx, at := range []time.Time{base, base.Add(time.Microsecond), base.Add(2*time.Microsecond + 789)} {
+		doc := &Document{UUID: uid, Tags: map[string]string{"Test/Sample": fmt.Sprintf("%d", idx)}}
+		if _, err := backend.InsertWithTimestamp(doc, at, false); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	edits, err := backend.History(ctx, uid, ZERO_TIME, ZERO_TIME)
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	var times []time.Time
+	for _, edit := range edits {
+		times = append(times, edit.Time.UTC())
+	}
+	// nanoseconds are truncated to the microseconds MySQL stores
+	if expected := []time.Time{base, base.Add(time.Microsecond), base.Add(2 * time.Microsecond)}; !reflect.DeepEqual(times, expected) {
+		t.Errorf("Got edits at %v but wanted %v", times, expected)
+	}
+
+	for querystring, expected := range map[string]string{
+		`select Test/Sample where has Test/Sample at 1447366661123456 us;`:              "0",
+		`select Test/Sample where has Test/Sample at 1447366661.123457;`:                "1",
+		`select Test/Sample where has Test/Sample at "2015-11-12T22:17:41.123457999Z";`: "1",
+		// the same nanosecond time as the last edit sees it
+		`select Test/Sample where has Test/Sample at 1447366661123458789 ns;`: "2",
+	} {
+		q, err := backend.Parse(querystring)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		docs, err := backend.Eval(ctx, q)
+		if err != nil {
+			t.Fatalf("Eval failed: %v", err)
+		}
+		var found *Document
+		for _, doc := range docs {
+			if doc.UUID == uid {
+				found = doc
+			}
+		}
+		if found == nil {
+			t.Errorf("Query %v: document not found", querystring)
+		} else if found.Tags["Test/Sample"] != expected {
+			t.Errorf("Query %v: got %v but wanted %v", querystring, found.Tags["Test/Sample"], expected)
+		}
+	}
+
+	got, err := backend.DocumentAt(ctx, uid, base.Add(time.Microsecond))
+	if err != nil {
+		t.Fatalf("DocumentAt failed: %v", err)
+	}
+	if got.Tags["Test/Sample"] != "1" || !got.TagTimes["Test/Sample"].Equal(base.Add(time.Microsecond)) {
+		t.Errorf("Got %v at %v but wanted 1 at %v", got.Tags, got.TagTimes, base.Add(time.Microsecond))
+	}
+}
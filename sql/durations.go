@@ -0,0 +1,62 @@
+package main
+
+import (
+	query "./lang"
+	"context"
+	"sort"
+	"time"
+)
+
+// The total time a value of a key of a document was in effect within the
+// window of a duration(Key) select term
+type ValueDuration struct {
+	Key      string        `json:"key"`
+	Value    string        `json:"value"`
+	Duration time.Duration `json:"-"`
+	// the duration in seconds, for clients
+	Seconds float64 `json:"seconds"`
+}
+
+// Returns the durations selected by the query's duration(Key) terms, by
+// document UUID. Within a document they are ordered by key, then by
+// decreasing duration. Only the durations of the documents the query matches
+// are read. Like transitions, they are read before the documents
+func durations(ctx context.Context, db queryer, q *query.Query) (map[string][]ValueDuration, error) {
+	found := map[string][]ValueDuration{}
+	for _, term := range q.Selects {
+		if term.Filter != query.DURATION {
+			continue
+		}
+		rows, err := db.QueryContext(ctx, term.DurationSQL(matchedCondition("data.uuid", q)))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var (
+				duuid        string
+				microseconds int64
+				value        = ValueDuration{Key: term.Tag}
+			)
+			if err = rows.Scan(&duuid, &value.Value, &microseconds); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			value.Duration = time.Duration(microseconds) * time.Microsecond
+			value.Seconds = value.Duration.Seconds()
+			found[duuid] = append(found[duuid], value)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for _, values := range found {
+		sort.SliceStable(values, func(i, j int) bool {
+			if values[i].Key != values[j].Key {
+				return values[i].Key < values[j].Key
+			}
+			return values[i].Duration > values[j].Duration
+		})
+	}
+	return found, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"github.com/satori/go.uuid"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDurations(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	ctx := context.Background()
+	var uids []uuid.UUID
+	for _, s := range []string{"a1b2c3d4-8cbd-11e5-8bb3-0cc47a0f7eea", "a5b6c7d8-8cbd-11e5-8bb3-0cc47a0f7eea"} {
+		uid, _ := uuid.FromString(s)
+		uids = append(uids, uid)
+		defer removeDocument(backend, uid)
+	}
+	for _, edit := range []struct {
+		doc  int
+		val  string
+		time int64
+	}{
+		// faulted for 2000s of the window (1000, 10000), over two intervals
+		{0, "fault", 0},
+		{0, "ok", 2000},
+		{0, "fault", 9000},
+		// faulted for 1000s, then removed
+		{1, "ok", 500},
+		{1, "fault", 3000},
+		{1, "", 4000},
+	} {
+		doc := &Document{UUID: uids[edit.doc], Tags: map[string]string{"Test/Status": edit.val}}
+		if _, err := backend.InsertWithTimestamp(doc, time.Unix(edit.time, 0), false); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		querystring string
+		matches     []uuid.UUID
+	}{
+		{`select * where Test/Status = "fault" for at least 2000s in (1000, 10000);`, uids[:1]},
+		{`select * where Test/Status = "fault" for at least 1000s in (1000, 10000);`, uids},
+		{`select * where Test/Status = "fault" for at least 1001s in (1000, 4500);`, nil},
+	} {
+		q, err := backend.Parse(test.querystring)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		docs, err := backend.Eval(ctx, q)
+		if err != nil {
+			t.Fatalf("Eval failed: %v", err)
+		}
+		var got []uuid.UUID
+		for _, doc := range docs {
+			got = append(got, doc.UUID)
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i].String() < got[j].String() })
+		if !reflect.DeepEqual(got, test.matches) {
+			t.Errorf("Query %v: got %v but wanted %v", test.querystring, got, test.matches)
+		}
+	}
+
+	q, err := backend.Parse(`select duration(Test/Status) in (1000, 10000) where has Test/Status;`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	spans, err := durations(ctx, backend.db, q)
+	if err != nil {
+		t.Fatalf("Durations failed: %v", err)
+	}
+	// the last fault is cut off by the end of the window
+	expected := []ValueDuration{
+		{"Test/Status", "ok", 7000 * time.Second, 7000},
+		{"Test/Status", "fault", 2000 * time.Second, 2000},
+	}
+	if got := spans[uids[0].String()]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got durations %v but wanted %v", got, expected)
+	}
+	// the second document no longer has the key, so the query does not match it
+	if got, found := spans[uids[1].String()]; found {
+		t.Errorf("Expected no durations for an unmatched document but got %v", got)
+	}
+}
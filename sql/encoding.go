@@ -0,0 +1,251 @@
+package main
+
+import (
+	query "./lang"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Writes the documents that result from a query in some format
+type resultEncoder interface {
+	// writes a single document
+	Encode(doc *Document) error
+	// finishes the output after the last document
+	Close() error
+}
+
+// An output format for query results
+type resultFormat struct {
+	// value of the "format" parameter
+	Name string
+	// MIME types matched against the Accept header; the first one is used as
+	// the Content-Type of the response
+	ContentTypes []string
+	New          func(w io.Writer, selects []query.SelectTerm) resultEncoder
+}
+
+var resultFormats = []resultFormat{
+	{"json", []string{"application/json"}, newJSONEncoder},
+	{"ndjson", []string{"application/x-ndjson", "application/ndjson"}, newNDJSONEncoder},
+	{"csv", []string{"text/csv"}, newCSVEncoder},
+	{"msgpack", []string{"application/msgpack", "application/x-msgpack"}, newMsgpackEncoder},
+}
+
+// Picks the output format from the "format" parameter if it is given, and
+// otherwise from the Accept header. Defaults to JSON
+func negotiateFormat(r *http.Request) (resultFormat, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		for _, format := range resultFormats {
+			if format.Name == name {
+				return format, nil
+			}
+		}
+		return resultFormats[0], fmt.Errorf("Unknown format %q", name)
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mimetype := strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0])
+		for _, format := range resultFormats {
+			for _, contentType := range format.ContentTypes {
+				if mimetype == contentType {
+					return format, nil
+				}
+			}
+		}
+	}
+	return resultFormats[0], nil
+}
+
+// Writes the documents as a single JSON array
+type jsonEncoder struct {
+	w     io.Writer
+	count int
+}
+
+func newJSONEncoder(w io.Writer, selects []query.SelectTerm) resultEncoder {
+	return &jsonEncoder{w: w}
+}
+
+func (enc *jsonEncoder) Encode(doc *Document) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	sep := ","
+	if enc.count == 0 {
+		sep = "["
+	}
+	enc.count += 1
+	if _, err = io.WriteString(enc.w, sep); err != nil {
+		return err
+	}
+	_, err = enc.w.Write(b)
+	return err
+}
+
+func (enc *jsonEncoder) Close() error {
+	var err error
+	if enc.count == 0 {
+		_, err = io.WriteString(enc.w, "[]\n")
+	} else {
+		_, err = io.WriteString(enc.w, "]\n")
+	}
+	return err
+}
+
+// Writes one JSON document per line, flushing after each document so that
+// clients can consume results as they are produced
+type ndjsonEncoder struct {
+	w   io.Writer
+	enc *json.Encoder
+}
+
+func newNDJSONEncoder(w io.Writer, selects []query.SelectTerm) resultEncoder {
+	return &ndjsonEncoder{w: w, enc: json.NewEncoder(w)}
+}
+
+func (enc *ndjsonEncoder) Encode(doc *Document) error {
+	if err := enc.enc.Encode(doc); err != nil {
+		return err
+	}
+	if flusher, ok := enc.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+func (enc *ndjsonEncoder) Close() error {
+	return nil
+}
+
+// Writes a CSV table with a "uuid" column followed by one column per selected
+// key. Keys missing from a document are left empty. When the query selects
+// "*", the columns are every key of the returned documents in sorted order, so
+// the documents are buffered until all are known
+type csvEncoder struct {
+	w       *csv.Writer
+	columns []string
+	// documents buffered until the columns are known
+	buffered []*Document
+	// if true, columns are taken from the documents
+	allKeys     bool
+	wroteHeader bool
+}
+
+func newCSVEncoder(w io.Writer, selects []query.SelectTerm) resultEncoder {
+	enc := &csvEncoder{w: csv.NewWriter(w)}
+	seen := map[string]bool{"uuid": true}
+	for _, term := range selects {
+		if term.Tag == "*" {
+			enc.allKeys = true
+		} else if !seen[term.Tag] {
+			seen[term.Tag] = true
+			enc.columns = append(enc.columns, term.Tag)
+		}
+	}
+	return enc
+}
+
+func (enc *csvEncoder) Encode(doc *Document) error {
+	if enc.allKeys {
+		enc.buffered = append(enc.buffered, doc)
+		return nil
+	}
+	return enc.write(doc)
+}
+
+func (enc *csvEncoder) write(doc *Document) error {
+	if err := enc.writeHeader(); err != nil {
+		return err
+	}
+	record := make([]string, 0, len(enc.columns)+1)
+	record = append(record, doc.UUID.String())
+	for _, key := range enc.columns {
+		record = append(record, doc.Tags[key])
+	}
+	if err := enc.w.Write(record); err != nil {
+		return err
+	}
+	enc.w.Flush()
+	return enc.w.Error()
+}
+
+func (enc *csvEncoder) Close() error {
+	if enc.allKeys {
+		keys := map[string]bool{}
+		for _, column := range enc.columns {
+			keys[column] = true
+		}
+		for _, doc := range enc.buffered {
+			for key := range doc.Tags {
+				if !keys[key] {
+					keys[key] = true
+					enc.columns = append(enc.columns, key)
+				}
+			}
+		}
+		sort.Strings(enc.columns)
+		for _, doc := range enc.buffered {
+			if err := enc.write(doc); err != nil {
+				return err
+			}
+		}
+		enc.buffered = nil
+	}
+	if err := enc.writeHeader(); err != nil {
+		return err
+	}
+	enc.w.Flush()
+	return enc.w.Error()
+}
+
+func (enc *csvEncoder) writeHeader() error {
+	if enc.wroteHeader {
+		return nil
+	}
+	enc.wroteHeader = true
+	return enc.w.Write(append([]string{"uuid"}, enc.columns...))
+}
+
+// Writes a stream of MessagePack maps, one per document, with the same keys
+// as the JSON encoding
+type msgpackEncoder struct {
+	enc *msgpack.Encoder
+}
+
+func newMsgpackEncoder(w io.Writer, selects []query.SelectTerm) resultEncoder {
+	return &msgpackEncoder{enc: msgpack.NewEncoder(w)}
+}
+
+func (enc *msgpackEncoder) Encode(doc *Document) error {
+	encoded := map[string]interface{}{
+		"uuid":       doc.UUID.String(),
+		"tags":       doc.Tags,
+		"tag_times":  doc.TagTimes,
+		"valid_time": doc.ValidTime,
+	}
+	if len(doc.Transitions) > 0 {
+		changes := make([]map[string]interface{}, len(doc.Transitions))
+		for idx, change := range doc.Transitions {
+			changes[idx] = map[string]interface{}{"key": change.Key, "from": change.From, "to": change.To, "time": change.Time}
+		}
+		encoded["transitions"] = changes
+	}
+	if len(doc.Durations) > 0 {
+		spans := make([]map[string]interface{}, len(doc.Durations))
+		for idx, span := range doc.Durations {
+			spans[idx] = map[string]interface{}{"key": span.Key, "value": span.Value, "seconds": span.Seconds}
+		}
+		encoded["durations"] = spans
+	}
+	return enc.enc.Encode(encoded)
+}
+
+func (enc *msgpackEncoder) Close() error {
+	return nil
+}
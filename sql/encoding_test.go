@@ -0,0 +1,87 @@
+package main
+
+import (
+	query "./lang"
+	"bytes"
+	"github.com/satori/go.uuid"
+	"net/http"
+	"testing"
+)
+
+func TestResultEncoders(t *testing.T) {
+	uuid1, _ := uuid.FromString("2b365d6a-8cbd-11e5-8bb3-0cc47a0f7eea")
+	uuid2, _ := uuid.FromString("370dd17c-8cbd-11e5-8bb3-0cc47a0f7eea")
+	docs := []*Document{
+		{UUID: uuid1, Tags: map[string]string{"Location/Room": "410", "Location/Building": "Soda"}},
+		{UUID: uuid2, Tags: map[string]string{"Location/Room": "4,11"}},
+	}
+	for _, test := range []struct {
+		new     func(*bytes.Buffer, []query.SelectTerm) resultEncoder
+		selects []query.SelectTerm
+		docs    []*Document
+		output  string
+	}{
+		{
+			func(b *bytes.Buffer, s []query.SelectTerm) resultEncoder { return newCSVEncoder(b, s) },
+			[]query.SelectTerm{{Tag: "Location/Room"}},
+			docs,
+			"uuid,Location/Room\n2b365d6a-8cbd-11e5-8bb3-0cc47a0f7eea,410\n370dd17c-8cbd-11e5-8bb3-0cc47a0f7eea,\"4,11\"\n",
+		},
+		{
+			func(b *bytes.Buffer, s []query.SelectTerm) resultEncoder { return newCSVEncoder(b, s) },
+			[]query.SelectTerm{{Tag: "*"}},
+			docs,
+			"uuid,Location/Building,Location/Room\n2b365d6a-8cbd-11e5-8bb3-0cc47a0f7eea,Soda,410\n370dd17c-8cbd-11e5-8bb3-0cc47a0f7eea,,\"4,11\"\n",
+		},
+		{
+			func(b *bytes.Buffer, s []query.SelectTerm) resultEncoder { return newJSONEncoder(b, s) },
+			[]query.SelectTerm{{Tag: "*"}},
+			[]*Document{},
+			"[]\n",
+		},
+		{
+			func(b *bytes.Buffer, s []query.SelectTerm) resultEncoder { return newNDJSONEncoder(b, s) },
+			[]query.SelectTerm{{Tag: "*"}},
+			docs[1:],
+			`{"uuid":"370dd17c-8cbd-11e5-8bb3-0cc47a0f7eea","tags":{"Location/Room":"4,11"},"tag_times":null,"valid_time":"0001-01-01T00:00:00Z"}` + "\n",
+		},
+	} {
+		var b bytes.Buffer
+		enc := test.new(&b, test.selects)
+		for _, doc := range test.docs {
+			if err := enc.Encode(doc); err != nil {
+				t.Errorf("Encode failed: %v", err)
+			}
+		}
+		if err := enc.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+		if b.String() != test.output {
+			t.Errorf("Got output\n%s\nbut wanted\n%s", b.String(), test.output)
+		}
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	for _, test := range []struct {
+		url    string
+		accept string
+		format string
+		ok     bool
+	}{
+		{"/query", "", "json", true},
+		{"/query", "text/csv", "csv", true},
+		{"/query", "text/html, application/x-ndjson;q=0.9", "ndjson", true},
+		{"/query?format=msgpack", "text/csv", "msgpack", true},
+		{"/query?format=xml", "", "", false},
+	} {
+		r, _ := http.NewRequest("POST", test.url, nil)
+		r.Header.Set("Accept", test.accept)
+		format, err := negotiateFormat(r)
+		if test.ok != (err == nil) {
+			t.Errorf("%s (Accept: %s): expected ok %v but got err %v", test.url, test.accept, test.ok, err)
+		} else if test.ok && format.Name != test.format {
+			t.Errorf("%s (Accept: %s): got format %s but wanted %s", test.url, test.accept, format.Name, test.format)
+		}
+	}
+}
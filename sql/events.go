@@ -0,0 +1,66 @@
+package main
+
+import (
+	query "./lang"
+	"context"
+	"fmt"
+	"time"
+)
+
+// Named events, which times in queries may refer to (see query.Event). They
+// are not versioned: redefining an event replaces it
+var eventsCreate = `
+CREATE TABLE IF NOT EXISTS events
+(
+    name VARCHAR(128) NOT NULL PRIMARY KEY,
+    start_time DATETIME(6) NOT NULL,
+    end_time DATETIME(6) NOT NULL
+);
+`
+
+var eventsTemplate = `select name, start_time, end_time from events;`
+
+var defineEventTemplate = `
+INSERT INTO events (name, start_time, end_time) VALUES (?, ?, ?)
+ON DUPLICATE KEY UPDATE start_time = VALUES(start_time), end_time = VALUES(end_time);
+`
+
+// Returns every defined event by name
+func (mbd *mysqlBackend) Events(ctx context.Context) (map[string]query.Event, error) {
+	rows, err := mbd.db.QueryContext(ctx, eventsTemplate)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := map[string]query.Event{}
+	for rows.Next() {
+		var event query.Event
+		if err = rows.Scan(&event.Name, &event.Start, &event.End); err != nil {
+			return nil, err
+		}
+		events[event.Name] = event
+	}
+	return events, rows.Err()
+}
+
+// Stores the event, replacing any event with the same name
+func (mbd *mysqlBackend) DefineEvent(ctx context.Context, event query.Event) error {
+	if event.End.Before(event.Start) {
+		return fmt.Errorf("Event %s ends before it starts", event.Name)
+	}
+	_, err := mbd.db.ExecContext(ctx, defineEventTemplate, event.Name, event.Start, event.End)
+	return err
+}
+
+// Returns a lexer for the statements that knows the defined events and reads
+// times in the given time zone
+func (mbd *mysqlBackend) newLexer(querystring string, loc *time.Location) (*query.QueryLex, error) {
+	events, err := mbd.Events(context.Background())
+	if err != nil {
+		return nil, &query.QueryError{Kind: query.EvalError, Message: fmt.Sprintf("Could not load events (%v)", err)}
+	}
+	lex := query.NewQueryLexer(querystring)
+	lex.Events = events
+	lex.Location = loc
+	return lex, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"github.com/satori/go.uuid"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	ctx := context.Background()
+	uid, _ := uuid.FromString("e1f2a3b4-8cbd-11e5-8bb3-0cc47a0f7eea")
+	defer removeDocument(backend, uid)
+	defer backend.db.Exec("DELETE FROM events WHERE name = ?;", "testsag")
+	for _, edit := range []struct {
+		val  string
+		time int64
+	}{{"410", 100}, {"420", 300}} {
+		doc := &Document{UUID: uid, Tags: map[string]string{"Test/Room": edit.val}}
+		if _, err := backend.InsertWithTimestamp(doc, time.Unix(edit.time, 0), false); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	queries, err := backend.ParseAll(`define event testsag in (150, 350);`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	results, err := backend.EvalBatch(ctx, queries, false)
+	if err != nil || results[0].Error != nil {
+		t.Fatalf("Define failed: %v %v", err, results[0].Error)
+	}
+	events, err := backend.Events(ctx)
+	if err != nil {
+		t.Fatalf("Events failed: %v", err)
+	}
+	if event := events["testsag"]; !event.Start.Equal(time.Unix(150, 0)) || !event.End.Equal(time.Unix(350, 0)) {
+		t.Errorf("Got event %v but wanted [150, 350]", event)
+	}
+
+	// later statements see the stored event
+	for querystring, room := range map[string]string{
+		`select * where Test/Room = "410" at testsag.start;`: "410",
+		`select * where Test/Room = "420" at testsag.end;`:   "420",
+	} {
+		q, err := backend.Parse(querystring)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		docs, err := backend.Eval(ctx, q)
+		if err != nil {
+			t.Fatalf("Eval failed: %v", err)
+		}
+		if len(docs) != 1 || docs[0].UUID != uid {
+			t.Errorf("Query %v: expected the document in room %s but got %v", querystring, room, docs)
+		}
+	}
+
+	// transactions are read-only, so they cannot define events
+	queries, err = backend.ParseAll(`define event testsag in (100, 200); select * where has Test/Room;`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if _, err = backend.EvalBatch(ctx, queries, true); err == nil {
+		t.Errorf("Expected defining an event in a transaction to fail")
+	}
+	if events, err = backend.Events(ctx); err != nil {
+		t.Fatalf("Events failed: %v", err)
+	}
+	if event := events["testsag"]; !event.Start.Equal(time.Unix(150, 0)) {
+		t.Errorf("Expected the event to be unchanged but got %v", event)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	query "./lang"
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+)
+
+// Explanation describes how a query is evaluated without running it: the
+// parsed select and where clauses, the SQL sent to the backend and the plan
+// the backend chooses for that SQL
+type Explanation struct {
+	Selects []string         `json:"selects"`
+	Where   *query.WhereNode `json:"where,omitempty"`
+	SQL     string           `json:"sql,omitempty"`
+	// the output of the backend's EXPLAIN, one row per table access
+	PlanColumns []string   `json:"plan_columns,omitempty"`
+	Plan        [][]string `json:"plan,omitempty"`
+}
+
+// Explains the query. The backend is asked for its plan, but the query
+// itself is not run
+func (mbd *mysqlBackend) Explain(ctx context.Context, q *query.Query) (*Explanation, error) {
+	return mbd.explain(ctx, mbd.db, q)
+}
+
+func (mbd *mysqlBackend) explain(ctx context.Context, db queryer, q *query.Query) (*Explanation, error) {
+	var explanation = &Explanation{
+		Where: q.Wheres.Node,
+		SQL:   querySQL(q),
+	}
+	for _, term := range q.Selects {
+		explanation.Selects = append(explanation.Selects, term.String())
+	}
+	if q.Traversal != nil {
+		explanation.Selects = append(explanation.Selects, q.Traversal.String())
+	}
+	if explanation.SQL == "" {
+		return explanation, nil
+	}
+	rows, err := db.QueryContext(ctx, "EXPLAIN "+explanation.SQL)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+	if explanation.PlanColumns, err = rows.Columns(); err != nil {
+		return nil, err
+	}
+	var (
+		values = make([]sql.NullString, len(explanation.PlanColumns))
+		dest   = make([]interface{}, len(values))
+	)
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := make([]string, len(values))
+		for i, value := range values {
+			if value.Valid {
+				row[i] = value.String
+			} else {
+				row[i] = "NULL"
+			}
+		}
+		explanation.Plan = append(explanation.Plan, row)
+	}
+	return explanation, contextError(ctx, rows.Err())
+}
+
+// Formats the explanation for the REPL
+func (e *Explanation) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Select: %s\n", strings.Join(e.Selects, ", "))
+	if e.Where != nil {
+		fmt.Fprintf(&buf, "Where:\n%s", e.Where.String())
+	}
+	if e.SQL != "" {
+		fmt.Fprintf(&buf, "SQL:%s", e.SQL)
+	}
+	if len(e.Plan) > 0 {
+		buf.WriteString("Plan:\n")
+		w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, strings.Join(e.PlanColumns, "\t"))
+		for _, row := range e.Plan {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		w.Flush()
+	}
+	return buf.String()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	query "./lang"
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+
+	q, err := backend.Parse(`explain select Location/Room where Location/Room = '410' and has Metadata/Exposure;`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if !q.Explain {
+		t.Fatalf("Expected an explain statement")
+	}
+	explanation, err := backend.Explain(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Explain failed: %v", err)
+	}
+	if len(explanation.Selects) != 1 || explanation.Selects[0] != "Location/Room" {
+		t.Errorf("Expected select Location/Room but got %v", explanation.Selects)
+	}
+	if explanation.Where == nil || explanation.Where.Op != "and" || len(explanation.Where.Children) != 2 {
+		t.Errorf("Expected an and of 2 terms but got %v", explanation.Where)
+	}
+	if !strings.Contains(explanation.SQL, `data.dkey = "Metadata/Exposure"`) {
+		t.Errorf("Generated SQL does not contain the has term:\n%v", explanation.SQL)
+	}
+	if len(explanation.PlanColumns) == 0 || len(explanation.Plan) == 0 {
+		t.Errorf("Expected a plan from the backend but got %v %v", explanation.PlanColumns, explanation.Plan)
+	}
+
+	// explain statements are answered in batches without being evaluated
+	results, err := backend.EvalBatch(context.Background(), []*query.Query{q}, false)
+	if err != nil {
+		t.Fatalf("EvalBatch failed: %v", err)
+	}
+	if results[0].Explain == nil || results[0].Documents != nil {
+		t.Errorf("Expected an explanation and no documents but got %+v", results[0])
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	query "./lang"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Which way a traversal follows references between documents
+type Direction int
+
+const (
+	// from a document to the documents that refer to it, e.g. from an AHU to
+	// the VAVs it feeds, whose Equipment/AHU holds its UUID
+	Downstream Direction = iota
+	// from a document to the documents its link keys refer to
+	Upstream
+)
+
+// Parses "downstream" or "upstream"
+func parseDirection(s string) (Direction, error) {
+	switch strings.ToLower(s) {
+	case "downstream":
+		return Downstream, nil
+	case "upstream":
+		return Upstream, nil
+	}
+	return Downstream, fmt.Errorf("Invalid direction %q (expected downstream or upstream)", s)
+}
+
+// Describes a traversal of the graph formed by documents whose link keys hold
+// the UUIDs of other documents
+type Traversal struct {
+	// the keys that hold references; values that are not UUIDs are ignored
+	Keys      []string
+	Direction Direction
+	// the largest number of references followed from the root, or 0 for no
+	// limit
+	Depth int
+	// the time at which both the references and the documents are resolved,
+	// or zero for their current versions
+	At time.Time
+}
+
+// A reference from one document to another through a link key
+type Link struct {
+	From uuid.UUID `json:"from"`
+	To   uuid.UUID `json:"to"`
+	Key  string    `json:"key"`
+}
+
+// A document reached by a traversal
+type Reached struct {
+	Document *Document `json:"document"`
+	// the number of references followed from the root
+	Depth int `json:"depth"`
+	// the UUIDs of the documents from the root to this one, inclusive
+	Path []uuid.UUID `json:"path"`
+}
+
+// The documents reached from a root, in breadth-first order. The root itself
+// is not included
+type TraversalResult struct {
+	Root    uuid.UUID  `json:"root"`
+	Reached []*Reached `json:"reached"`
+	// references that lead back to a document on the path to them, which are
+	// not followed
+	Cycles []Link `json:"cycles"`
+}
+
+// the latest value of each key of the documents matching the condition at a
+// time
+var snapshotAtTemplate = `
+select data.uuid, data.dkey, data.dval, data.timestamp from data
+inner join
+(
+    select uuid, dkey, max(timestamp) as maxtime from data
+    where timestamp <= ? and %s
+    group by uuid, dkey
+) latest
+on data.uuid = latest.uuid and data.dkey = latest.dkey and data.timestamp = latest.maxtime
+where data.dval is not null
+order by data.uuid;
+`
+
+var snapshotCurrentTemplate = `
+select uuid, dkey, dval, timestamp from current
+where dval is not null and %s
+order by uuid;
+`
+
+// the latest value of the link keys of the documents that had a matching
+// value at a time, keeping only the matching values
+var linksAtTemplate = `
+select data.uuid, data.dkey, data.dval, data.timestamp from data
+inner join
+(
+    select uuid, dkey, max(timestamp) as maxtime from data
+    where timestamp <= ? and dkey in (%[1]s) and uuid in
+    (
+        select candidates.uuid from data as candidates
+        where candidates.timestamp <= ? and candidates.dkey in (%[1]s) and candidates.%[2]s in (%[3]s)
+    )
+    group by uuid, dkey
+) latest
+on data.uuid = latest.uuid and data.dkey = latest.dkey and data.timestamp = latest.maxtime
+where data.dval is not null and data.%[2]s in (%[3]s)
+order by data.uuid;
+`
+
+var linksCurrentTemplate = `
+select uuid, dkey, dval, timestamp from current
+where dval is not null and dkey in (%[1]s) and %[2]s in (%[3]s)
+order by uuid;
+`
+
+// Returns the documents as they were at the given time (or their current
+// versions if it is zero), with only the rows matching the condition on
+// column, which is one of values
+func snapshot(ctx context.Context, db queryer, column string, values []string, at time.Time) ([]*Document, error) {
+	if len(values) == 0 {
+		return []*Document{}, nil
+	}
+	var (
+		args         []interface{}
+		placeholders = make([]string, 0, len(values))
+		rows         *sql.Rows
+		err          error
+	)
+	if at != ZERO_TIME {
+		args = append(args, at)
+	}
+	for _, value := range values {
+		args = append(args, value)
+		placeholders = append(placeholders, "?")
+	}
+	condition := fmt.Sprintf("%s in (%s)", column, strings.Join(placeholders, ", "))
+	if at != ZERO_TIME {
+		rows, err = db.QueryContext(ctx, fmt.Sprintf(snapshotAtTemplate, condition), args...)
+	} else {
+		rows, err = db.QueryContext(ctx, fmt.Sprintf(snapshotCurrentTemplate, condition), args...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	docs, err := DocsFromRows(rows, at)
+	if err != nil {
+		return nil, err
+	}
+	return docs, rows.Err()
+}
+
+// Returns the link keys that hold the references followed from the frontier
+// in the traversal's direction, as they were at the time of the traversal:
+// the link keys of the frontier documents going upstream, and those that
+// refer to them going downstream
+func frontierLinks(ctx context.Context, db queryer, frontier []string, t Traversal) ([]*Document, error) {
+	if len(frontier) == 0 {
+		return []*Document{}, nil
+	}
+	column := "dval"
+	if t.Direction == Upstream {
+		column = "uuid"
+	}
+	keys := strings.TrimSuffix(strings.Repeat("?, ", len(t.Keys)), ", ")
+	uids := strings.TrimSuffix(strings.Repeat("?, ", len(frontier)), ", ")
+	var keyArgs, uidArgs, args []interface{}
+	for _, key := range t.Keys {
+		keyArgs = append(keyArgs, key)
+	}
+	for _, uid := range frontier {
+		uidArgs = append(uidArgs, uid)
+	}
+	// the past links are looked up by their values, then checked to be the
+	// latest ones, so the keys and UUIDs appear twice in that template
+	template := linksCurrentTemplate
+	if t.At != ZERO_TIME {
+		template = linksAtTemplate
+		args = append(args, t.At)
+		args = append(args, keyArgs...)
+		args = append(args, t.At)
+	}
+	args = append(args, keyArgs...)
+	args = append(args, uidArgs...)
+	if t.At != ZERO_TIME {
+		args = append(args, uidArgs...)
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(template, keys, column, uids), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	docs, err := DocsFromRows(rows, t.At)
+	if err != nil {
+		return nil, err
+	}
+	return docs, rows.Err()
+}
+
+// Returns the references between the documents through their link keys, by
+// the document they are followed from in the given direction. The references
+// of each document are sorted by key, then UUID
+func linkGraph(docs []*Document, keys []string, direction Direction) map[uuid.UUID][]Link {
+	graph := map[uuid.UUID][]Link{}
+	for _, doc := range docs {
+		for _, key := range keys {
+			val, found := doc.Tags[key]
+			if !found {
+				continue
+			}
+			target, err := uuid.FromString(val)
+			if err != nil {
+				continue
+			}
+			link := Link{From: doc.UUID, To: target, Key: key}
+			if direction == Upstream {
+				graph[link.From] = append(graph[link.From], link)
+			} else {
+				graph[link.To] = append(graph[link.To], Link{From: link.To, To: link.From, Key: key})
+			}
+		}
+	}
+	for _, links := range graph {
+		sort.Slice(links, func(i, j int) bool {
+			if links[i].Key != links[j].Key {
+				return links[i].Key < links[j].Key
+			}
+			return links[i].To.String() < links[j].To.String()
+		})
+	}
+	return graph
+}
+
+// Walks the graph breadth first from the root, following at most depth links
+// (any number if depth is 0). Every document is reached once, through its
+// shortest path. Links back to a document on the path to the document they
+// are followed from are returned as cycles
+func traverse(graph map[uuid.UUID][]Link, root uuid.UUID, depth int) ([]*Reached, []Link) {
+	w := newWalk(root, depth)
+	for !w.done() {
+		w.step(graph)
+	}
+	return w.reached, w.cycles
+}
+
+// A breadth-first walk from a root, advanced one level at a time so that the
+// links of each level can be read just before they are followed
+type walk struct {
+	root     uuid.UUID
+	depth    int
+	level    int
+	reached  []*Reached
+	cycles   []Link
+	paths    map[uuid.UUID][]uuid.UUID
+	frontier []uuid.UUID
+}
+
+func newWalk(root uuid.UUID, depth int) *walk {
+	return &walk{root: root, depth: depth, paths: map[uuid.UUID][]uuid.UUID{root: {root}}, frontier: []uuid.UUID{root}}
+}
+
+// Whether the walk has reached every document it can
+func (w *walk) done() bool {
+	return len(w.frontier) == 0 || (w.depth > 0 && w.level >= w.depth)
+}
+
+// Follows the links from the frontier, which must be in the graph, to the
+// next level
+func (w *walk) step(graph map[uuid.UUID][]Link) {
+	w.level++
+	var next []uuid.UUID
+	for _, from := range w.frontier {
+		for _, link := range graph[from] {
+			if _, seen := w.paths[link.To]; seen {
+				if onPath(w.paths[from], link.To) {
+					w.cycles = append(w.cycles, link)
+				}
+				continue
+			}
+			path := append(append([]uuid.UUID{}, w.paths[from]...), link.To)
+			w.paths[link.To] = path
+			w.reached = append(w.reached, &Reached{Depth: w.level, Path: path})
+			next = append(next, link.To)
+		}
+	}
+	w.frontier = next
+}
+
+func onPath(path []uuid.UUID, uid uuid.UUID) bool {
+	for _, step := range path {
+		if step == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the documents reached from the root by following the references in
+// the traversal's link keys. The references and the reached documents are
+// resolved at the same time, so a traversal at a past time sees the topology
+// and the documents as they were then. A referenced document that did not
+// exist at that time is reached with no tags. The traversal is cancelled when
+// ctx is done or the query timeout passes
+func (mbd *mysqlBackend) Traverse(ctx context.Context, root uuid.UUID, t Traversal) (*TraversalResult, error) {
+	ctx, cancel := mbd.withTimeout(ctx)
+	defer cancel()
+	results, err := mbd.traverse(ctx, mbd.db, []uuid.UUID{root}, t)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return results[0], nil
+}
+
+// Evaluates a query with a traverse(Key, ...) select term, returning the
+// traversal from each document that matches the WHERE clause, in the order
+// the documents are matched
+func (mbd *mysqlBackend) EvalTraversal(ctx context.Context, q *query.Query) ([]*TraversalResult, error) {
+	ctx, cancel := mbd.withTimeout(ctx)
+	defer cancel()
+	return mbd.evalTraversal(ctx, mbd.db, q)
+}
+
+func (mbd *mysqlBackend) evalTraversal(ctx context.Context, db queryer, q *query.Query) ([]*TraversalResult, error) {
+	if q.Traversal == nil {
+		return nil, fmt.Errorf("Query has no traversal")
+	}
+	// the matching documents are read before following their references,
+	// since db may be a transaction
+	docs, err := mbd.eval(ctx, db, q)
+	if err != nil {
+		return nil, err
+	}
+	roots := make([]uuid.UUID, len(docs))
+	for idx, doc := range docs {
+		roots[idx] = doc.UUID
+	}
+	t := Traversal{Keys: q.Traversal.Keys, Depth: q.Traversal.Depth, At: q.Traversal.At}
+	if q.Traversal.Upstream {
+		t.Direction = Upstream
+	}
+	results, err := mbd.traverse(ctx, db, roots, t)
+	return results, contextError(ctx, err)
+}
+
+// Returns the traversal from each root. The walks from all the roots advance
+// together, one level per query: only the references followed from the
+// documents on their frontiers are read, and those of each document once
+func (mbd *mysqlBackend) traverse(ctx context.Context, db queryer, roots []uuid.UUID, t Traversal) ([]*TraversalResult, error) {
+	if len(t.Keys) == 0 {
+		return nil, fmt.Errorf("A traversal needs at least one link key")
+	}
+	walks := make([]*walk, len(roots))
+	for idx, root := range roots {
+		walks[idx] = newWalk(root, t.Depth)
+	}
+	graph := map[uuid.UUID][]Link{}
+	expanded := map[uuid.UUID]bool{}
+	for {
+		var (
+			active   []*walk
+			frontier []string
+		)
+		for _, w := range walks {
+			if w.done() {
+				continue
+			}
+			active = append(active, w)
+			for _, uid := range w.frontier {
+				if !expanded[uid] {
+					expanded[uid] = true
+					frontier = append(frontier, uid.String())
+				}
+			}
+		}
+		if len(active) == 0 {
+			break
+		}
+		links, err := frontierLinks(ctx, db, frontier, t)
+		if err != nil {
+			return nil, err
+		}
+		for from, followed := range linkGraph(links, t.Keys, t.Direction) {
+			graph[from] = followed
+		}
+		for _, w := range active {
+			w.step(graph)
+		}
+	}
+	results := make([]*TraversalResult, 0, len(roots))
+	for _, w := range walks {
+		result, err := traversalResult(ctx, db, w, t)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Reads the documents reached by the walk at the time of the traversal
+func traversalResult(ctx context.Context, db queryer, w *walk, t Traversal) (*TraversalResult, error) {
+	reached, cycles := w.reached, w.cycles
+	uids := make([]string, len(reached))
+	for idx, node := range reached {
+		uids[idx] = node.Path[len(node.Path)-1].String()
+	}
+	docs, err := snapshot(ctx, db, "uuid", uids, t.At)
+	if err != nil {
+		return nil, err
+	}
+	byUUID := map[uuid.UUID]*Document{}
+	for _, doc := range docs {
+		byUUID[doc.UUID] = doc
+	}
+	for _, node := range reached {
+		uid := node.Path[len(node.Path)-1]
+		if node.Document = byUUID[uid]; node.Document == nil {
+			node.Document = &Document{UUID: uid, Tags: map[string]string{}, TagTimes: map[string]time.Time{}, ValidTime: t.At}
+		}
+	}
+	if reached == nil {
+		reached = []*Reached{}
+	}
+	if cycles == nil {
+		cycles = []Link{}
+	}
+	return &TraversalResult{Root: w.root, Reached: reached, Cycles: cycles}, nil
+}
+
+// Formats the traversal for the REPL
+func (result *TraversalResult) PrettyString() string {
+	if b, err := json.MarshalIndent(result, "", "  "); err != nil {
+		return fmt.Sprintf("ERROR FORMATTING (%v) %v", err, result)
+	} else {
+		return string(b)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"github.com/satori/go.uuid"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTraverse(t *testing.T) {
+	var uids []uuid.UUID
+	for _, s := range []string{
+		"c1000000-8cbd-11e5-8bb3-0cc47a0f7eea", // AHU
+		"c2000000-8cbd-11e5-8bb3-0cc47a0f7eea", // VAV fed by the AHU
+		"c3000000-8cbd-11e5-8bb3-0cc47a0f7eea", // room fed by the VAV
+		"c4000000-8cbd-11e5-8bb3-0cc47a0f7eea", // VAV fed by the room, closing a cycle
+	} {
+		uid, _ := uuid.FromString(s)
+		uids = append(uids, uid)
+	}
+	ahu, vav, room, loop := uids[0], uids[1], uids[2], uids[3]
+	docs := []*Document{
+		{UUID: ahu, Tags: map[string]string{"Equipment/Fed": loop.String()}},
+		{UUID: vav, Tags: map[string]string{"Equipment/AHU": ahu.String()}},
+		{UUID: room, Tags: map[string]string{"Equipment/VAV": vav.String(), "Equipment/AHU": "not a uuid"}},
+		{UUID: loop, Tags: map[string]string{"Equipment/VAV": room.String()}},
+	}
+	keys := []string{"Equipment/AHU", "Equipment/VAV", "Equipment/Fed"}
+
+	graph := linkGraph(docs, keys, Downstream)
+	reached, cycles := traverse(graph, ahu, 0)
+	expected := []*Reached{
+		{Depth: 1, Path: []uuid.UUID{ahu, vav}},
+		{Depth: 2, Path: []uuid.UUID{ahu, vav, room}},
+		{Depth: 3, Path: []uuid.UUID{ahu, vav, room, loop}},
+	}
+	if !reflect.DeepEqual(reached, expected) {
+		t.Errorf("Got %v but wanted %v", reached, expected)
+	}
+	if expectedCycles := []Link{{From: loop, To: ahu, Key: "Equipment/Fed"}}; !reflect.DeepEqual(cycles, expectedCycles) {
+		t.Errorf("Got cycles %v but wanted %v", cycles, expectedCycles)
+	}
+
+	if reached, _ = traverse(graph, ahu, 2); len(reached) != 2 {
+		t.Errorf("Expected 2 documents within depth 2 but got %v", reached)
+	}
+
+	// a walk only follows the links of its frontier, so those of the next
+	// level can be read after each step
+	w := newWalk(ahu, 0)
+	w.step(map[uuid.UUID][]Link{ahu: graph[ahu]})
+	if !reflect.DeepEqual(w.frontier, []uuid.UUID{vav}) || len(w.reached) != 1 || w.done() {
+		t.Errorf("Expected the walk to reach the VAV after one step but got %v", w.reached)
+	}
+
+	reached, cycles = traverse(linkGraph(docs, keys, Upstream), room, 0)
+	expected = []*Reached{
+		{Depth: 1, Path: []uuid.UUID{room, vav}},
+		{Depth: 2, Path: []uuid.UUID{room, vav, ahu}},
+		{Depth: 3, Path: []uuid.UUID{room, vav, ahu, loop}},
+	}
+	if !reflect.DeepEqual(reached, expected) {
+		t.Errorf("Got %v but wanted %v", reached, expected)
+	}
+	if expectedCycles := []Link{{From: loop, To: room, Key: "Equipment/VAV"}}; !reflect.DeepEqual(cycles, expectedCycles) {
+		t.Errorf("Got cycles %v but wanted %v", cycles, expectedCycles)
+	}
+}
+
+func TestTraverseAt(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	ctx := context.Background()
+	var uids []uuid.UUID
+	for _, s := range []string{"d1e2f3a4-8cbd-11e5-8bb3-0cc47a0f7eea", "d5e6f7a8-8cbd-11e5-8bb3-0cc47a0f7eea", "d9eaf0a1-8cbd-11e5-8bb3-0cc47a0f7eea", "dde0f1a2-8cbd-11e5-8bb3-0cc47a0f7eea"} {
+		uid, _ := uuid.FromString(s)
+		uids = append(uids, uid)
+		defer removeDocument(backend, uid)
+	}
+	ahu, otherAHU, vav, room := uids[0], uids[1], uids[2], uids[3]
+	for _, edit := range []struct {
+		doc  uuid.UUID
+		tags map[string]string
+		time int64
+	}{
+		{ahu, map[string]string{"Test/Type": "AHU"}, 100},
+		{otherAHU, map[string]string{"Test/Type": "AHU"}, 100},
+		{vav, map[string]string{"Test/Type": "VAV", "Test/AHU": ahu.String()}, 100},
+		{room, map[string]string{"Test/Type": "Room", "Test/VAV": vav.String()}, 100},
+		// the VAV is moved to the other AHU and renamed
+		{vav, map[string]string{"Test/AHU": otherAHU.String(), "Test/Type": "VAV-2"}, 200},
+	} {
+		doc := &Document{UUID: edit.doc, Tags: edit.tags}
+		if _, err := backend.InsertWithTimestamp(doc, time.Unix(edit.time, 0), false); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		root     uuid.UUID
+		at       time.Time
+		expected []uuid.UUID
+		types    []string
+	}{
+		{ahu, time.Unix(150, 0), []uuid.UUID{vav, room}, []string{"VAV", "Room"}},
+		{ahu, ZERO_TIME, nil, nil},
+		{otherAHU, ZERO_TIME, []uuid.UUID{vav, room}, []string{"VAV-2", "Room"}},
+	} {
+		result, err := backend.Traverse(ctx, test.root, Traversal{Keys: []string{"Test/AHU", "Test/VAV"}, At: test.at})
+		if err != nil {
+			t.Fatalf("Traverse failed: %v", err)
+		}
+		var (
+			got   []uuid.UUID
+			types []string
+		)
+		for _, node := range result.Reached {
+			got = append(got, node.Document.UUID)
+			types = append(types, node.Document.Tags["Test/Type"])
+		}
+		if !reflect.DeepEqual(got, test.expected) || !reflect.DeepEqual(types, test.types) {
+			t.Errorf("Traversal from %v at %v: got %v %v but wanted %v %v", test.root, test.at, got, types, test.expected, test.types)
+		}
+	}
+
+	// the same traversal from every AHU, written in the query language
+	q, err := backend.Parse(`select traverse(Test/AHU, Test/VAV) depth 1 at 150 where Test/Type = "AHU";`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	results, err := backend.EvalTraversal(ctx, q)
+	if err != nil {
+		t.Fatalf("EvalTraversal failed: %v", err)
+	}
+	reached := map[uuid.UUID][]uuid.UUID{}
+	for _, result := range results {
+		for _, node := range result.Reached {
+			reached[result.Root] = append(reached[result.Root], node.Document.UUID)
+		}
+	}
+	if expected := map[uuid.UUID][]uuid.UUID{ahu: {vav}}; len(results) != 2 || !reflect.DeepEqual(reached, expected) {
+		t.Errorf("Got traversals %v from %d documents but wanted %v from 2", reached, len(results), expected)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A change to the value of a single key of a document. An empty Old value
+// means the key was added, and an empty New value means the key was removed
+type TagChange struct {
+	Key string `json:"key"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// The set of keys of a document that changed at a single point in time
+type Edit struct {
+	Time    time.Time   `json:"time"`
+	Changes []TagChange `json:"changes"`
+}
+
+// Replays the edits to a single document in timestamp order, keeping track of
+// the value of each key so that every edit can be turned into a diff
+type historyBuilder struct {
+	// the value of each key as of the last applied edit
+	current map[string]string
+	// only edits at or after this time are reported
+	start time.Time
+	edits []*Edit
+}
+
+func newHistoryBuilder(start time.Time) *historyBuilder {
+	return &historyBuilder{current: map[string]string{}, start: start, edits: []*Edit{}}
+}
+
+// applies the new value of a key at the given time. Times must be
+// non-decreasing across calls. Writing the current value again is not a change
+func (hb *historyBuilder) apply(key, val string, t time.Time) {
+	old := hb.current[key]
+	if val == "" {
+		delete(hb.current, key)
+	} else {
+		hb.current[key] = val
+	}
+	if old == val || t.Before(hb.start) {
+		return
+	}
+	var edit *Edit
+	if len(hb.edits) > 0 && hb.edits[len(hb.edits)-1].Time.Equal(t) {
+		edit = hb.edits[len(hb.edits)-1]
+	} else {
+		edit = &Edit{Time: t}
+		hb.edits = append(hb.edits, edit)
+	}
+	edit.Changes = append(edit.Changes, TagChange{Key: key, Old: old, New: val})
+}
+
+// returns the edits applied so far with the changes of each edit sorted by key
+func (hb *historyBuilder) history() []*Edit {
+	for _, edit := range hb.edits {
+		sort.Slice(edit.Changes, func(i, j int) bool { return edit.Changes[i].Key < edit.Changes[j].Key })
+	}
+	return hb.edits
+}
+
+// Generate the ordered list of edits to a document from the results of a SQL
+// query over its rows. Rows must be ordered by timestamp and include all edits
+// before start so that the values being changed are known
+func HistoryFromRows(rows *sql.Rows, start time.Time) ([]*Edit, error) {
+	if rows == nil {
+		return nil, fmt.Errorf("No rows returned")
+	}
+	hb := newHistoryBuilder(start)
+	for rows.Next() {
+		var (
+			dkey  string
+			dval  sql.NullString
+			dtime time.Time
+		)
+		if err := rows.Scan(&dkey, &dval, &dtime); err != nil {
+			return nil, err
+		}
+		hb.apply(dkey, dval.String, dtime)
+	}
+	return hb.history(), rows.Err()
+}
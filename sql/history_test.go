@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"github.com/satori/go.uuid"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type historyRow struct {
+	key, val string
+	t        time.Time
+}
+
+func TestHistoryBuilder(t *testing.T) {
+	for _, test := range []struct {
+		start   time.Time
+		applied []historyRow
+		edits   []*Edit
+	}{
+		{
+			ZERO_TIME,
+			[]historyRow{
+				{"Location/Room", "410", time.Unix(1, 0)},
+				{"Location/Building", "Soda", time.Unix(1, 0)},
+				{"Location/Room", "411", time.Unix(2, 0)},
+				{"Location/Room", "411", time.Unix(3, 0)}, // no-op
+				{"Location/Building", "", time.Unix(4, 0)},
+			},
+			[]*Edit{
+				{time.Unix(1, 0), []TagChange{{"Location/Building", "", "Soda"}, {"Location/Room", "", "410"}}},
+				{time.Unix(2, 0), []TagChange{{"Location/Room", "410", "411"}}},
+				{time.Unix(4, 0), []TagChange{{"Location/Building", "Soda", ""}}},
+			},
+		},
+		{
+			time.Unix(2, 0),
+			[]historyRow{
+				{"Location/Room", "410", time.Unix(1, 0)},
+				{"Location/Room", "411", time.Unix(2, 0)},
+			},
+			[]*Edit{
+				{time.Unix(2, 0), []TagChange{{"Location/Room", "410", "411"}}},
+			},
+		},
+	} {
+		hb := newHistoryBuilder(test.start)
+		for _, a := range test.applied {
+			hb.apply(a.key, a.val, a.t)
+		}
+		if history := hb.history(); !reflect.DeepEqual(history, test.edits) {
+			t.Errorf("Got history %v but wanted %v", history, test.edits)
+		}
+	}
+}
+
+func TestDocumentAt(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	uuid5, _ := uuid.FromString("411ce89c-8cbd-11e5-8bb3-0cc47a0f7eea")
+
+	for _, test := range []struct {
+		at   time.Time
+		tags map[string]string
+	}{
+		{time.Unix(4, 0), map[string]string{}},
+		{time.Unix(7, 0), map[string]string{"Location/Room": "410"}},
+		{time.Unix(8, 0), map[string]string{"Location/Room": "405"}},
+		{time.Unix(18, 0), map[string]string{"Location/Room": "405", "Metadata/Exposure": "South"}},
+		{time.Unix(19, 0), map[string]string{"Location/Room": "405"}},
+	} {
+		doc, err := backend.DocumentAt(context.Background(), uuid5, test.at)
+		if err != nil {
+			t.Errorf("DocumentAt %v failed: %v", test.at, err)
+			continue
+		}
+		for key, val := range test.tags {
+			if doc.Tags[key] != val {
+				t.Errorf("DocumentAt %v: expected %v = %v but got %v", test.at, key, val, doc.Tags[key])
+			}
+		}
+		if _, found := doc.Tags["Metadata/Exposure"]; found && test.tags["Metadata/Exposure"] == "" {
+			t.Errorf("DocumentAt %v: unexpected key Metadata/Exposure", test.at)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	uuid5, _ := uuid.FromString("411ce89c-8cbd-11e5-8bb3-0cc47a0f7eea")
+
+	history, err := backend.History(context.Background(), uuid5, time.Unix(8, 0), time.Unix(19, 0))
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	expected := []*Edit{
+		{time.Unix(8, 0), []TagChange{{"Location/Room", "410", "405"}}},
+		{time.Unix(13, 0), []TagChange{{"Metadata/Point/Sensor", "", "Temperature"}, {"Metadata/Point/Type", "", "Sensor"}}},
+		{time.Unix(18, 0), []TagChange{{"Metadata/Exposure", "", "South"}}},
+	}
+	if len(history) != len(expected) {
+		t.Fatalf("Got history %v but wanted %v", history, expected)
+	}
+	for idx, edit := range history {
+		if !edit.Time.Equal(expected[idx].Time) || !reflect.DeepEqual(edit.Changes, expected[idx].Changes) {
+			t.Errorf("Got edit %v but wanted %v", edit, expected[idx])
+		}
+	}
+}
@@ -2,11 +2,17 @@ package main
 
 import (
 	query "./lang"
-	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/satori/go.uuid"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type httpServer struct {
@@ -17,46 +23,575 @@ type httpServer struct {
 func StartHTTPServer(backend *mysqlBackend, port int) {
 	h := &httpServer{Port: port, Backend: backend}
 	http.HandleFunc("/query", h.HandleQuery)
+	http.HandleFunc("/documents", h.HandleBulkInsert)
+	http.HandleFunc("/documents/", h.HandleDocument)
+	http.HandleFunc("/batch", h.HandleBatch)
 	log.Printf("Starting HTTP server on port %d\n", port)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
 }
 
-//TODO: currently does not support semicolons embedded inside queries
+// Evaluates the statements in the request body, each terminated by a
+// semicolon. A body with a single statement returns the matching documents in
+// the format chosen by the "format" parameter or the Accept header (see
+// resultFormats). A body with several statements returns a JSON list with one
+// result per statement. If the "transaction" parameter is true, the statements
+// are evaluated in a single transaction that is rolled back on the first error.
+// Queries are cancelled if the client goes away, and the optional "timeout"
+// parameter (e.g. "30s") shortens the time each statement may run
 func (h *httpServer) HandleQuery(w http.ResponseWriter, r *http.Request) {
-	var (
-		parsed   *query.Query
-		parseErr error
-		evalErr  error
-		docs     []*Document
-		encoder  *json.Encoder
-	)
-	reqBody := bufio.NewReader(r.Body)
-	s, err := reqBody.ReadString(';')
+	defer r.Body.Close()
+	ctx := r.Context()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeQueryError(w, &query.QueryError{Kind: query.ParseError, Message: fmt.Sprintf("Could not read query (%v)", err)})
+		return
+	}
+	transactional, _ := strconv.ParseBool(r.URL.Query().Get("transaction"))
+	format, err := negotiateFormat(r)
 	if err != nil {
-		w.WriteHeader(400) // Bad Request
-		w.Write([]byte("Could not find ';' to terminate query"))
-		goto deliver
+		http.Error(w, err.Error(), 406) // Not Acceptable
+		return
+	}
+	if param := r.URL.Query().Get("timeout"); param != "" {
+		timeout, err := time.ParseDuration(param)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid timeout parameter (%v)", err), 400)
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
 	// parse query
-	parsed, parseErr = h.Backend.Parse(s)
+	parsed, parseErr := h.Backend.ParseAll(string(body))
 	if parseErr != nil {
-		w.WriteHeader(400) // Bad Request
-		w.Write([]byte(parseErr.Error()))
-		goto deliver
+		writeQueryError(w, query.AsQueryError(query.ParseError, parseErr))
+		return
 	}
 
 	// eval query
-	docs, evalErr = h.Backend.Eval(parsed)
+	if len(parsed) == 1 && parsed[0].Explain {
+		explanation, explainErr := h.Backend.Explain(ctx, parsed[0])
+		if explainErr != nil {
+			writeQueryError(w, query.AsQueryError(query.EvalError, explainErr))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(explanation)
+		return
+	}
+	if len(parsed) == 1 && parsed[0].Timezone != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"timezone": parsed[0].Timezone.String()})
+		return
+	}
+	if len(parsed) == 1 && parsed[0].Define != nil && !transactional {
+		if defineErr := h.Backend.DefineEvent(ctx, *parsed[0].Define); defineErr != nil {
+			writeQueryError(w, query.AsQueryError(query.EvalError, defineErr))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(parsed[0].Define)
+		return
+	}
+	if len(parsed) == 1 && !transactional {
+		if _, isDiff := parsed[0].Diff(); isDiff {
+			diffs, diffErr := h.Backend.EvalDiff(ctx, parsed[0])
+			if diffErr != nil {
+				writeQueryError(w, query.AsQueryError(query.EvalError, diffErr))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(diffs)
+			return
+		}
+	}
+	if len(parsed) == 1 && parsed[0].Traversal != nil && !transactional {
+		traversals, traversalErr := h.Backend.EvalTraversal(ctx, parsed[0])
+		if traversalErr != nil {
+			writeQueryError(w, query.AsQueryError(query.EvalError, traversalErr))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(traversals)
+		return
+	}
+	if len(parsed) == 1 && !transactional {
+		iter, evalErr := h.Backend.EvalStream(ctx, parsed[0])
+		if evalErr != nil {
+			writeQueryError(w, query.AsQueryError(query.EvalError, evalErr))
+			return
+		}
+		defer iter.Close()
+		w.Header().Set("Content-Type", format.ContentTypes[0])
+		encoder := format.New(w, parsed[0].Selects)
+		for iter.Next() {
+			if err = encoder.Encode(iter.Document()); err != nil {
+				log.Printf("Error encoding %s results: %v", format.Name, err)
+				return
+			}
+		}
+		// the response has already started, so errors can only be logged
+		if evalErr = iter.Err(); evalErr != nil {
+			log.Printf("Error evaluating query: %v", evalErr)
+			return
+		}
+		if err = encoder.Close(); err != nil {
+			log.Printf("Error encoding %s results: %v", format.Name, err)
+		}
+		return
+	}
+	if format.Name != "json" {
+		http.Error(w, "Queries with several statements can only return JSON", 406) // Not Acceptable
+		return
+	}
+	results, evalErr := h.Backend.EvalBatch(ctx, parsed, transactional)
 	if evalErr != nil {
-		w.WriteHeader(500) // server error
-		w.Write([]byte(evalErr.Error()))
-		goto deliver
+		writeQueryError(w, query.AsQueryError(query.EvalError, evalErr))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// Writes the error as a JSON object with a status code matching its kind
+func writeQueryError(w http.ResponseWriter, qe *query.QueryError) {
+	var status int
+	switch qe.Kind {
+	case query.LexError, query.ParseError:
+		status = 400 // Bad Request
+	case query.TimeoutError:
+		status = 504 // Gateway Timeout
+	case query.CanceledError:
+		status = 503 // Service Unavailable
+	default:
+		status = 500 // server error
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]*query.QueryError{"error": qe})
+}
+
+// A single line of the NDJSON body accepted by POST /documents
+type bulkEdit struct {
+	UUID      string             `json:"uuid"`
+	Tags      map[string]*string `json:"tags"`
+	Timestamp string             `json:"timestamp"`
+	Until     string             `json:"until"`
+}
+
+// Serves a single document. GET /documents/{uuid} returns the current version
+// of the document, or the version at the time given by the "at" parameter.
+// GET /documents/{uuid}/history returns the ordered list of edits to the
+// document in the range given by the optional "start" and "end" parameters.
+// GET /documents/{uuid}/diff returns the changes to the document between the
+// "from" and "to" parameters (see DiffAt).
+// GET /documents/{uuid}/traverse returns the documents reached from the
+// document through the link keys given by the "key" parameters (see
+// getTraversal).
+// POST, PATCH and DELETE edit the document (see editDocument).
+func (h *httpServer) HandleDocument(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/documents/"), "/")
+	uid, err := uuid.FromString(path[0])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid document UUID (%v)", err), 400)
+		return
+	}
+	switch {
+	case len(path) == 1 && r.Method == "GET":
+		h.getDocument(w, r, uid)
+	case len(path) == 1:
+		h.editDocument(w, r, uid)
+	case len(path) == 2 && path[1] == "history" && r.Method == "GET":
+		h.getHistory(w, r, uid)
+	case len(path) == 2 && path[1] == "diff" && r.Method == "GET":
+		h.getDiff(w, r, uid)
+	case len(path) == 2 && path[1] == "traverse" && r.Method == "GET":
+		h.getTraversal(w, r, uid)
+	case len(path) == 2 && (path[1] == "history" || path[1] == "diff" || path[1] == "traverse"):
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", 405)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *httpServer) getDocument(w http.ResponseWriter, r *http.Request, uid uuid.UUID) {
+	at, err := timeParam(r, "at")
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	doc, err := h.Backend.DocumentAt(r.Context(), uid, at)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if len(doc.Tags) == 0 {
+		http.Error(w, fmt.Sprintf("No document %v", uid), 404)
+		return
+	}
+	json.NewEncoder(w).Encode(doc)
+}
+
+func (h *httpServer) getHistory(w http.ResponseWriter, r *http.Request, uid uuid.UUID) {
+	start, err := timeParam(r, "start")
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	end, err := timeParam(r, "end")
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	history, err := h.Backend.History(r.Context(), uid, start, end)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(history)
+}
+
+func (h *httpServer) getDiff(w http.ResponseWriter, r *http.Request, uid uuid.UUID) {
+	from, err := timeParam(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	to, err := timeParam(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	diff, err := h.Backend.DiffAt(r.Context(), uid, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(diff)
+}
+
+// Follows the references in the "key" parameters from the document. The
+// optional "direction" parameter is "downstream" (the default) or "upstream",
+// "depth" limits the number of references followed and "at" resolves the
+// references and documents at a past time (see Traverse)
+func (h *httpServer) getTraversal(w http.ResponseWriter, r *http.Request, uid uuid.UUID) {
+	params := r.URL.Query()
+	t := Traversal{Keys: params["key"]}
+	if len(t.Keys) == 0 {
+		http.Error(w, "At least one key parameter is required", 400)
+		return
+	}
+	var err error
+	if direction := params.Get("direction"); direction != "" {
+		if t.Direction, err = parseDirection(direction); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	if depth := params.Get("depth"); depth != "" {
+		if t.Depth, err = strconv.Atoi(depth); err != nil || t.Depth < 0 {
+			http.Error(w, fmt.Sprintf("Invalid depth parameter %q", depth), 400)
+			return
+		}
+	}
+	if t.At, err = timeParam(r, "at"); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	result, err := h.Backend.Traverse(r.Context(), uid, t)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// The body of POST and PATCH requests is a JSON map of tags; a null or empty
+// value removes that key. POST replaces the document with the given tags, so
+// keys not mentioned in the body are removed. PATCH changes only the given
+// tags. DELETE removes the keys named by the "key" parameters, or every key of
+// the document if none are given. All three accept an optional "timestamp"
+// parameter at which the edit is applied; otherwise the edit is applied at the
+// current time. With an "until" parameter, the edit only holds until that
+// time (see InsertInterval). Tags that would not change the document are not
+// written unless the "force" parameter is true. Responds with the keys that
+// changed.
+func (h *httpServer) editDocument(w http.ResponseWriter, r *http.Request, uid uuid.UUID) {
+	timestamp, err := timeParam(r, "timestamp")
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	until, err := timeParam(r, "until")
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if until != ZERO_TIME && timestamp != ZERO_TIME && !until.After(timestamp) {
+		http.Error(w, "The until parameter must be after the timestamp", 400)
+		return
+	}
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+
+	doc := &Document{UUID: uid, Tags: map[string]string{}}
+	switch r.Method {
+	case "POST", "PATCH":
+		var tags map[string]*string
+		if err = json.NewDecoder(r.Body).Decode(&tags); err != nil {
+			http.Error(w, fmt.Sprintf("Could not decode tags (%v)", err), 400)
+			return
+		}
+		doc.Tags = tagsFromJSON(tags)
+		if r.Method == "POST" {
+			err = h.removeMissingKeys(r.Context(), doc)
+		}
+	case "DELETE":
+		for _, key := range r.URL.Query()["key"] {
+			doc.Tags[key] = ""
+		}
+		if len(doc.Tags) == 0 {
+			err = h.removeMissingKeys(r.Context(), doc)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST, PATCH, DELETE")
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	var changed []string
+	if until != ZERO_TIME {
+		changed, err = h.Backend.InsertInterval(doc, timestamp, until, force)
+	} else {
+		changed, err = h.Backend.InsertWithTimestamp(doc, timestamp, force)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), writeStatus(err))
+		return
+	}
+	if changed == nil {
+		changed = []string{}
 	}
+	json.NewEncoder(w).Encode(map[string][]string{"changed": changed})
+}
+
+// Returns the status of a failed write: 409 if it kept conflicting with
+// concurrent writes, which the client may retry, and 500 otherwise
+func writeStatus(err error) int {
+	if err == ErrConflict {
+		return 409 // Conflict
+	}
+	return 500
+}
+
+// the number of edits committed together by POST /documents
+const bulkBatchSize = 500
+
+// Applies a newline-delimited list of edits. Each line is a JSON object
+// {"uuid": ..., "tags": {...}, "timestamp": ..., "until": ...} (timestamp and
+// until are optional) and is applied like a PATCH to that document. Edits may be in any order of
+// time; they are committed in batches of bulkBatchSize, each of which is
+// applied in time order. As with single edits, the "force" parameter writes
+// tags that would not change their documents. Responds with the number of
+// edits applied; on error, the line number of the failed edit is reported,
+// the batches committed before it remain applied and the rest of its batch is
+// discarded.
+func (h *httpServer) HandleBulkInsert(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var (
+		batch    *Batch
+		pending  int
+		applied  int
+		force, _ = strconv.ParseBool(r.URL.Query().Get("force"))
+	)
+	flush := func() error {
+		if batch == nil {
+			return nil
+		}
+		err := batch.Commit()
+		if err == nil {
+			applied += pending
+		}
+		batch, pending = nil, 0
+		return err
+	}
+	_, status, err := readEdits(r.Body, func(doc *Document, timestamp, until time.Time) error {
+		var err error
+		if batch == nil {
+			if batch, err = h.Backend.Begin(r.Context()); err != nil {
+				return err
+			}
+		}
+		if err = insertEdit(batch, doc, timestamp, until, force); err != nil {
+			return err
+		}
+		if pending += 1; pending >= bulkBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		if err = flush(); err != nil {
+			status = writeStatus(err)
+		}
+	} else if batch != nil {
+		// the rest of the failed batch is discarded, so that the count
+		// reports exactly the edits that were stored
+		batch.Rollback()
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v (%d edits applied)", err, applied), status)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]int{"applied": applied})
+}
 
-	encoder = json.NewEncoder(w)
-	encoder.Encode(docs)
-deliver:
-	reqBody.Discard(reqBody.Buffered())
-	r.Body.Close()
+// Applies a newline-delimited list of edits, in the same format as POST
+// /documents, atomically: either every edit becomes visible at once or, on
+// error, none do. Edits without a timestamp share the batch's transaction
+// timestamp, which is returned with the number of edits applied, the keys
+// each document changed (see the "force" parameter of editDocument) and the
+// edits of earlier transactions that the batch replaced.
+func (h *httpServer) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	batch, err := h.Backend.Begin(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	applied, status, err := readEdits(r.Body, func(doc *Document, timestamp, until time.Time) error {
+		return insertEdit(batch, doc, timestamp, until, force)
+	})
+	if err != nil {
+		batch.Rollback()
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if err = batch.Commit(); err != nil {
+		http.Error(w, err.Error(), writeStatus(err))
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"applied":   applied,
+		"timestamp": batch.Timestamp(),
+		"changed":   batch.Changed(),
+		"conflicts": batch.Conflicts(),
+	})
+}
+
+// Adds a decoded edit to the batch, as an interval-valued edit if it has an
+// until time
+func insertEdit(batch *Batch, doc *Document, timestamp, until time.Time, force bool) error {
+	if until != ZERO_TIME {
+		return batch.InsertInterval(doc, timestamp, until, force)
+	}
+	return batch.InsertWithTimestamp(doc, timestamp, force)
+}
+
+// Decodes the newline-delimited edits in the body and calls apply for each,
+// with a zero timestamp or until if the edit has none. Returns the number of edits
+// applied, or the status code and an error naming the line of the first edit
+// that could not be decoded or applied
+func readEdits(body io.Reader, apply func(doc *Document, timestamp, until time.Time) error) (int, int, error) {
+	var (
+		decoder = json.NewDecoder(body)
+		applied int
+	)
+	for line := 1; ; line++ {
+		var (
+			edit      bulkEdit
+			timestamp time.Time
+			until     time.Time
+		)
+		err := decoder.Decode(&edit)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return applied, 400, fmt.Errorf("Line %d: could not decode edit (%v)", line, err)
+		}
+		uid, err := uuid.FromString(edit.UUID)
+		if err != nil {
+			return applied, 400, fmt.Errorf("Line %d: invalid document UUID (%v)", line, err)
+		}
+		if edit.Timestamp != "" {
+			if timestamp, err = query.ParseTime(edit.Timestamp); err != nil {
+				return applied, 400, fmt.Errorf("Line %d: %v", line, err)
+			}
+		}
+		if edit.Until != "" {
+			if until, err = query.ParseTime(edit.Until); err != nil {
+				return applied, 400, fmt.Errorf("Line %d: %v", line, err)
+			}
+			if timestamp != ZERO_TIME && !until.After(timestamp) {
+				return applied, 400, fmt.Errorf("Line %d: until must be after the timestamp", line)
+			}
+		}
+		doc := &Document{UUID: uid, Tags: tagsFromJSON(edit.Tags)}
+		if err = apply(doc, timestamp, until); err != nil {
+			return applied, writeStatus(err), fmt.Errorf("Line %d: %v", line, err)
+		}
+		applied += 1
+	}
+	return applied, 200, nil
+}
+
+// parses the named URL parameter as a time. Returns the zero time if the
+// parameter is not given
+func timeParam(r *http.Request, name string) (time.Time, error) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return ZERO_TIME, nil
+	}
+	t, err := query.ParseTime(param)
+	if err != nil {
+		return t, fmt.Errorf("Invalid %s parameter (%v)", name, err)
+	}
+	return t, nil
+}
+
+// null values in a decoded JSON map of tags become empty values, which remove
+// the key from the document
+func tagsFromJSON(tags map[string]*string) map[string]string {
+	ret := make(map[string]string, len(tags))
+	for key, val := range tags {
+		if val != nil {
+			ret[key] = *val
+		} else {
+			ret[key] = ""
+		}
+	}
+	return ret
+}
+
+// marks every key of the current version of the document that is not
+// mentioned in doc.Tags as removed
+func (h *httpServer) removeMissingKeys(ctx context.Context, doc *Document) error {
+	current, err := h.Backend.CurrentDocument(ctx, doc.UUID)
+	if err != nil {
+		return err
+	}
+	for key := range current.Tags {
+		if _, found := doc.Tags[key]; !found {
+			doc.Tags[key] = ""
+		}
+	}
+	return nil
 }
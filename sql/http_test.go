@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"github.com/satori/go.uuid"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBulkInsertDiscardsFailedBatch(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	ctx := context.Background()
+	uid, _ := uuid.FromString("cbccd0e2-8cbd-11e5-8bb3-0cc47a0f7eea")
+	defer removeDocument(backend, uid)
+	h := &httpServer{Backend: backend}
+
+	body := `{"uuid": "` + uid.String() + `", "tags": {"Test/Bulk": "a"}}` + "\n" + `{"uuid": "not a uuid", "tags": {}}` + "\n"
+	w := httptest.NewRecorder()
+	h.HandleBulkInsert(w, httptest.NewRequest("POST", "/documents", strings.NewReader(body)))
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "(0 edits applied)") {
+		t.Errorf("Got %d %q but wanted 400 with no edits applied", w.Code, w.Body.String())
+	}
+	if doc, _ := backend.CurrentDocument(ctx, uid); len(doc.Tags) != 0 {
+		t.Errorf("Expected the edit before the failed line to be discarded but got %v", doc.Tags)
+	}
+}
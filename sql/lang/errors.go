@@ -0,0 +1,153 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The stage of handling a query at which an error occured
+type ErrorKind string
+
+const (
+	// the query contains text that is not a token
+	LexError ErrorKind = "lex"
+	// the tokens of the query do not form a valid statement
+	ParseError ErrorKind = "parse"
+	// the backend could not evaluate the query
+	EvalError ErrorKind = "eval"
+	// the query took too long to evaluate
+	TimeoutError ErrorKind = "timeout"
+	// the query was cancelled before it finished, e.g. because the client
+	// went away
+	CanceledError ErrorKind = "canceled"
+)
+
+// Human-readable names for the tokens reported by the parser
+var tokenDescriptions = map[string]string{
+	"$end":      "end of query",
+	"LVALUE":    "key",
+	"QSTRING":   "quoted string",
+	"NUMBER":    "number",
+	"LPAREN":    "'('",
+	"RPAREN":    "')'",
+	"COMMA":     "','",
+	"SEMICOLON": "';'",
+	"EQ":        "'='",
+	"NEQ":       "'!='",
+	"ALL":       "'*'",
+}
+
+func init() {
+	// report the unexpected and expected tokens in syntax errors
+	QueryErrorVerbose = true
+}
+
+// A QueryError describes why a query could not be handled. Line and Column
+// give the position of the offending token (starting at 1) and are 0 if the
+// error is not tied to a position in the query
+type QueryError struct {
+	Kind    ErrorKind `json:"kind"`
+	Message string    `json:"message"`
+	Line    int       `json:"line,omitempty"`
+	Column  int       `json:"column,omitempty"`
+	// the text of the offending token
+	Token string `json:"token,omitempty"`
+	// the tokens that would have been valid at that position
+	Expected []string `json:"expected,omitempty"`
+	// the line of the query containing the error with a caret under the
+	// offending token
+	Snippet string `json:"snippet,omitempty"`
+}
+
+func (e *QueryError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s error: %s", e.Kind, e.Message)
+	}
+	return fmt.Sprintf("%s error at line %d, column %d: %s", e.Kind, e.Line, e.Column, e.Message)
+}
+
+// Returns the error followed by the caret-style snippet, if there is one
+func (e *QueryError) Diagnostic() string {
+	if e.Snippet == "" {
+		return e.Error()
+	}
+	return e.Error() + "\n" + e.Snippet
+}
+
+// Creates an error of the given kind for the token at the given position of
+// the query. The snippet is filled in from the query
+func NewQueryError(kind ErrorKind, message, querystring string, line, column int, token string) *QueryError {
+	return &QueryError{
+		Kind:    kind,
+		Message: message,
+		Line:    line,
+		Column:  column,
+		Token:   token,
+		Snippet: snippet(querystring, line, column),
+	}
+}
+
+// Wraps an error from evaluating a query. QueryErrors are passed through
+func AsQueryError(kind ErrorKind, err error) *QueryError {
+	if qe, ok := err.(*QueryError); ok {
+		return qe
+	}
+	return &QueryError{Kind: kind, Message: err.Error()}
+}
+
+// Transforms a message from the parser of the form
+// "syntax error: unexpected X, expecting A or B" into a QueryError
+func newSyntaxError(message, querystring string, line, column int, token string) *QueryError {
+	qe := NewQueryError(ParseError, message, querystring, line, column, token)
+	if !strings.HasPrefix(message, "syntax error: unexpected ") {
+		return qe
+	}
+	unexpected := strings.TrimPrefix(message, "syntax error: unexpected ")
+	if idx := strings.Index(unexpected, ", expecting "); idx >= 0 {
+		for _, tok := range strings.Split(unexpected[idx+len(", expecting "):], " or ") {
+			qe.Expected = append(qe.Expected, describeToken(tok))
+		}
+		unexpected = unexpected[:idx]
+	}
+	qe.Message = "unexpected " + describeToken(unexpected)
+	if token != "" && unexpected != "$end" {
+		qe.Message += fmt.Sprintf(" %q", token)
+	}
+	if len(qe.Expected) > 0 {
+		qe.Message += ", expecting " + strings.Join(qe.Expected, " or ")
+	}
+	return qe
+}
+
+func describeToken(name string) string {
+	if desc, found := tokenDescriptions[name]; found {
+		return desc
+	}
+	return strings.ToLower(name)
+}
+
+// Returns the given line of the query followed by a line with a caret under
+// the given column
+func snippet(querystring string, line, column int) string {
+	lines := strings.Split(querystring, "\n")
+	if line < 1 || line > len(lines) || column < 1 {
+		return ""
+	}
+	text := strings.TrimRight(lines[line-1], "\r")
+	// keep tabs so the caret lines up with the text above it
+	var pad []rune
+	for idx, c := range text {
+		if idx >= column-1 {
+			break
+		}
+		if c == '\t' {
+			pad = append(pad, '\t')
+		} else {
+			pad = append(pad, ' ')
+		}
+	}
+	for len(pad) < column-1 {
+		pad = append(pad, ' ')
+	}
+	return text + "\n" + string(pad) + "^"
+}
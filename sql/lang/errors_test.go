@@ -0,0 +1,67 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQueryErrors(t *testing.T) {
+	for _, test := range []struct {
+		querystring string
+		err         *QueryError
+	}{
+		{
+			`select * where Location/Room = 410;`,
+			&QueryError{Kind: ParseError, Message: `unexpected number "410", expecting quoted string`, Line: 1, Column: 32, Token: "410",
+				Expected: []string{"quoted string"},
+				Snippet:  "select * where Location/Room = 410;\n                               ^"},
+		},
+		{
+			`select * where Location/Room @ "410";`,
+			&QueryError{Kind: LexError, Message: `unrecognized input "@"`, Line: 1, Column: 30, Token: "@",
+				Snippet: "select * where Location/Room @ \"410\";\n                             ^"},
+		},
+		{
+			`select * where`,
+			&QueryError{Kind: ParseError, Message: `unexpected end of query, expecting key or has or not or '('`, Line: 1, Column: 15,
+				Expected: []string{"key", "has", "not", "'('"},
+				Snippet:  "select * where\n              ^"},
+		},
+		{
+			`select * where change(Sensor/Model);`,
+			&QueryError{Kind: ParseError, Message: `unknown predicate change(), expecting changed()`, Line: 1, Column: 36, Token: ";",
+				Snippet: "select * where change(Sensor/Model);\n                                   ^"},
+		},
+		{
+			`select * where changed(Sensor/Model) form 'SHT11';`,
+			&QueryError{Kind: ParseError, Message: `unexpected form, expecting from`, Line: 1, Column: 50, Token: ";",
+				Snippet: "select * where changed(Sensor/Model) form 'SHT11';\n                                                 ^"},
+		},
+		{
+			`select * where changed(Sensor/Model) in (now, now -7d);`,
+			&QueryError{Kind: ParseError, Message: `the window of changed(Sensor/Model) ends before it starts`, Line: 1, Column: 54, Token: ")",
+				Snippet: "select * where changed(Sensor/Model) in (now, now -7d);\n                                                     ^"},
+		},
+		{
+			`select * where Equipment/AHU -> has Location/Building for (0, 10);`,
+			&QueryError{Kind: ParseError, Message: `Equipment/AHU -> can only be evaluated at a single time (at <time>)`, Line: 1, Column: 66, Token: ";",
+				Snippet: "select * where Equipment/AHU -> has Location/Building for (0, 10);\n                                                                 ^"},
+		},
+		{
+			`select * where Location/Room = "410";`,
+			nil,
+		},
+	} {
+		lex := NewQueryLexer(test.querystring)
+		QueryParse(lex)
+		if test.err == nil {
+			if lex.Err != nil {
+				t.Errorf("Query %v: unexpected error %v", test.querystring, lex.Err)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(lex.Err, test.err) {
+			t.Errorf("Query %v: got error\n%#v\nbut wanted\n%#v", test.querystring, lex.Err, test.err)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"bufio"
 	"fmt"
 	"strconv"
+	"strings"
 	_time "time"
 )
 %}
@@ -16,44 +17,113 @@ import (
 	selectTermList	[]SelectTerm
 	whereTerm  WhereTerm
 	whereClause  WhereClause
+	timeTerm	TimeTerm
+	transition	TransitionTerm
+	traversal	TraversalTerm
+	arg	funcArg
+	args	[]funcArg
 	time _time.Time
-	timediff _time.Duration
+	rel relTime
 }
 
-%token <str> SELECT DISTINCT WHERE
+%token <str> SELECT DISTINCT WHERE EXPLAIN
 %token <str> LVALUE QSTRING LIKE HAS
 %token <str> NOW SET AT BEFORE AFTER AND AS TO OR IN NOT FOR HAPPENS
 %token <str> LPAREN RPAREN NEWLINE
-%token <str> FIRST LAST IAFTER IBEFORE BETWEEN
+%token <str> FIRST LAST IAFTER IBEFORE BETWEEN DIFF DURATION
 %token NUMBER
 %token SEMICOLON
 
-%token <str> EQ NEQ COMMA ALL
+%token <str> EQ NEQ COMMA ALL ARROW
 
 %type <selectTermList> selectTermList selectClause
 %type <selectTerm> selectTerm selectTermValue
 %type <whereClause> whereClause
 %type <whereTerm> whereTerm
-%type <time> timeref abstime
-%type <timediff> reltime
-%type <str> NUMBER timeTerm
-// timeTerm is a string because it returns a SQL clause
+%type <time> timeref abstime timevalue
+%type <rel> reltime
+%type <str> NUMBER
+%type <timeTerm> timeTerm
+%type <transition> changeValues changeTerm
+%type <traversal> traversalLimits
+%type <arg> funcArg
+%type <args> funcArgs
 
 %right EQ
 
 %%
 
+statements	:	statement
+			|	statements statement
+			;
+
+statement	:	query
+			{
+				Querylex.(*QueryLex).EndStatement()
+			}
+			|	EXPLAIN query
+			{
+				Querylex.(*QueryLex).Query.Explain = true
+				Querylex.(*QueryLex).EndStatement()
+			}
+			|	definition
+			{
+				Querylex.(*QueryLex).EndStatement()
+			}
+			|	SET LVALUE QSTRING SEMICOLON
+			{
+				Querylex.(*QueryLex).expectWord($2, "timezone")
+				Querylex.(*QueryLex).setTimezone($3)
+				Querylex.(*QueryLex).EndStatement()
+			}
+			;
+
+/* define and event are not keywords, so that they can still be used as keys */
+definition	:	LVALUE LVALUE LVALUE IN LPAREN timeref COMMA timeref RPAREN SEMICOLON
+			{
+				Querylex.(*QueryLex).expectWord($1, "define")
+				Querylex.(*QueryLex).expectWord($2, "event")
+				Querylex.(*QueryLex).defineEvent($3, $6, $8)
+			}
+			|	LVALUE LVALUE LVALUE AT timeref SEMICOLON
+			{
+				Querylex.(*QueryLex).expectWord($1, "define")
+				Querylex.(*QueryLex).expectWord($2, "event")
+				Querylex.(*QueryLex).defineEvent($3, $5, $5)
+			}
+			;
+
 query	:	SELECT selectClause WHERE whereClause SEMICOLON
 		{
-			Querylex.(*QueryLex).Query.Selects = $2
+			Querylex.(*QueryLex).setSelects($2)
 			Querylex.(*QueryLex).Query.Wheres = $4
 		}
 		|	SELECT selectClause SEMICOLON
 		{
-			Querylex.(*QueryLex).Query.Selects = $2
+			Querylex.(*QueryLex).setSelects($2)
+			if Querylex.(*QueryLex).Query.Traversal != nil {
+				Querylex.(*QueryLex).Error("traverse() needs a where clause selecting the documents to start from")
+			}
 		}
 		;
 
+/* downstream, upstream and depth are not keywords, so that they can still be
+   used as keys */
+traversalLimits	:	LVALUE
+				{
+					$$ = Querylex.(*QueryLex).traversalDirection($1)
+				}
+				|	LVALUE NUMBER
+				{
+					$$ = TraversalTerm{Depth: Querylex.(*QueryLex).traversalDepth($1, $2)}
+				}
+				|	LVALUE LVALUE NUMBER
+				{
+					$$ = Querylex.(*QueryLex).traversalDirection($1)
+					$$.Depth = Querylex.(*QueryLex).traversalDepth($2, $3)
+				}
+				;
+
 selectClause	:	selectTermList
 				{
 					$$ = $1
@@ -130,6 +200,58 @@ selectTerm	: selectTermValue
 				$1.EndTime = $6
 				$$ = $1
 			}
+			|	LVALUE LPAREN funcArgs RPAREN
+			{
+				$$ = Querylex.(*QueryLex).function($1, $3)
+			}
+			|	LVALUE LPAREN funcArgs RPAREN traversalLimits
+			{
+				$$ = Querylex.(*QueryLex).traversal($1, $3, $5)
+			}
+			|	LVALUE LPAREN funcArgs RPAREN traversalLimits AT timeref
+			{
+				$5.At = $7
+				$$ = Querylex.(*QueryLex).traversal($1, $3, $5)
+			}
+			|	LVALUE LPAREN funcArgs RPAREN AT timeref
+			{
+				$$ = Querylex.(*QueryLex).traversal($1, $3, TraversalTerm{At: $6})
+			}
+			|	LVALUE LPAREN funcArgs RPAREN IN LPAREN timeref COMMA timeref RPAREN
+			{
+				$$ = Querylex.(*QueryLex).duration($1, $3, $7, $9)
+			}
+			;
+
+/* diff, traverse and the other function names are not keywords, so that they
+   can still be used as keys. Whether a bare name stands for a key or an event
+   depends on the function */
+funcArgs	:	funcArg
+			{
+				$$ = []funcArg{$1}
+			}
+			|	funcArg COMMA funcArgs
+			{
+				$$ = append([]funcArg{$1}, $3...)
+			}
+			;
+
+funcArg		:	LVALUE
+			{
+				$$ = funcArg{name: $1}
+			}
+			|	LVALUE reltime
+			{
+				$$ = funcArg{time: $2.addTo(Querylex.(*QueryLex).eventTime($1), Querylex.(*QueryLex).Location), isTime: true}
+			}
+			|	timevalue
+			{
+				$$ = funcArg{time: $1, isTime: true}
+			}
+			|	timevalue reltime
+			{
+				$$ = funcArg{time: $2.addTo($1, Querylex.(*QueryLex).Location), isTime: true}
+			}
 			;
 
 selectTermValue	:	LVALUE
@@ -147,21 +269,16 @@ whereClause :	whereTerm
 			{
 				letter := Querylex.(*QueryLex).NextLetter()
 				$1.Letter = letter
-				if ($1.IsPredicate) {
-					$$ = WrapTermInSelect($1.SQL, $1.Letter)
-				} else { // have a full select clause
-					$$ = WhereClause{SQL: $1.SQL, Letter: $1.Letter}
-				}
+				$$ = $1.GetClause()
+				$$.Node = $1.NodeWithTime(latestDescription)
 			}
 			|	whereTerm timeTerm
 			{
+				Querylex.(*QueryLex).checkJoin($1, $2)
 				letter := Querylex.(*QueryLex).NextLetter()
 				$1.Letter = letter
-				if ($1.IsPredicate) {
-					$$ = WrapTermInSelectWithTime($1.SQL, $1.Letter, $2)
-				} else { // have a full select clause
-					$$ = WhereClause{SQL: $1.SQL, Letter: $1.Letter}
-				}
+				$$ = $1.GetClauseWithTime($2)
+				$$.Node = $1.NodeWithTime($2.Description)
 			}
 			|	whereTerm OR whereClause
 			{
@@ -175,9 +292,11 @@ from
 union
 %s`, firstTerm.SQL, firstTerm.Letter, $3.SQL)
 				$$ = WhereClause{SQL: sql, Letter: firstTerm.Letter}
+				$$.Node = &WhereNode{Op: "or", Children: []*WhereNode{$1.NodeWithTime(latestDescription), $3.Node}}
 			}
 			|	whereTerm timeTerm OR whereClause
 			{
+				Querylex.(*QueryLex).checkJoin($1, $2)
 				letter := Querylex.(*QueryLex).NextLetter()
 				$1.Letter = letter
 				var firstTerm = $1.GetClauseWithTime($2)
@@ -188,6 +307,7 @@ from
 union
 %s`, firstTerm.SQL, firstTerm.Letter, $4.SQL)
 				$$ = WhereClause{SQL: sql, Letter: firstTerm.Letter}
+				$$.Node = &WhereNode{Op: "or", Children: []*WhereNode{$1.NodeWithTime($2.Description), $4.Node}}
 			}
 			|	whereTerm AND whereClause
 			{
@@ -202,9 +322,11 @@ inner join
 (%s) as %s
 on %s.uuid = %s.uuid`, firstTerm.Letter, firstTerm.SQL, firstTerm.Letter, $3.SQL, $3.Letter, firstTerm.Letter, $3.Letter)
 				$$ = WhereClause{SQL: sql, Letter: firstTerm.Letter}
+				$$.Node = &WhereNode{Op: "and", Children: []*WhereNode{$1.NodeWithTime(latestDescription), $3.Node}}
 			}
 			|	whereTerm timeTerm AND whereClause
 			{
+				Querylex.(*QueryLex).checkJoin($1, $2)
 				letter := Querylex.(*QueryLex).NextLetter()
 				$1.Letter = letter
 				var firstTerm = $1.GetClauseWithTime($2)
@@ -216,6 +338,7 @@ inner join
 (%s) as %s
 on %s.uuid = %s.uuid`, firstTerm.Letter, firstTerm.SQL, firstTerm.Letter, $4.SQL, $4.Letter, firstTerm.Letter, $4.Letter)
 				$$ = WhereClause{SQL: sql, Letter: firstTerm.Letter}
+				$$.Node = &WhereNode{Op: "and", Children: []*WhereNode{$1.NodeWithTime($2.Description), $4.Node}}
 			}
 			|	NOT whereClause
 			{
@@ -224,7 +347,7 @@ select distinct data.uuid
 from
 data
 where data.uuid not in (%s)`, $2.SQL)
-				$$ = WhereClause{SQL: sql, Letter: $2.Letter}
+				$$ = WhereClause{SQL: sql, Letter: $2.Letter, Node: &WhereNode{Op: "not", Children: []*WhereNode{$2.Node}}}
 			}
 			;
 
@@ -256,51 +379,121 @@ whereTerm	: LVALUE LIKE QSTRING
 			| HAS LVALUE
 			{
 				if $2 == "uuid" {
-					$$ = WhereTerm{Key: $1, Op: $1, SQL: `data.uuid is not null`, IsPredicate: true}
+					$$ = WhereTerm{Key: $2, Op: $1, SQL: `data.uuid is not null`, IsPredicate: true}
 				} else {
 					$$ = WhereTerm{Key: $2, Op: $1, SQL: fmt.Sprintf(`data.dkey = "%s"`, $2), IsPredicate: true}
 				}
 			}
 			| LPAREN whereClause RPAREN
 			{
-				$$ = WhereTerm{SQL: fmt.Sprintf(`(%s)`, $2.SQL), IsPredicate: false}
+				$$ = WhereTerm{SQL: fmt.Sprintf(`(%s)`, $2.SQL), IsPredicate: false, Node: $2.Node}
+			}
+			| LVALUE ARROW whereTerm
+			{
+				if !$3.IsPredicate || $3.Link != "" {
+					Querylex.(*QueryLex).Error(fmt.Sprintf("%s -> must be followed by a predicate on a single key", $1))
+				}
+				$3.Link = $1
+				$$ = $3
+			}
+			| changeTerm
+			{
+				Querylex.(*QueryLex).Query.Transitions = append(Querylex.(*QueryLex).Query.Transitions, $1)
+				sql := fmt.Sprintf(`(select distinct uuid from (%s) as transitions)`, $1.SQL(""))
+				$$ = WhereTerm{SQL: sql, IsPredicate: false, Node: $1.Node()}
+			}
+			;
+
+/* changed and from are not keywords, so that they can still be used as keys */
+changeTerm	: LVALUE LPAREN LVALUE RPAREN changeValues
+			{
+				Querylex.(*QueryLex).checkFunction($1)
+				$5.Key = $3
+				$$ = $5
+			}
+			| LVALUE LPAREN LVALUE RPAREN changeValues IN LPAREN timeref COMMA timeref RPAREN
+			{
+				Querylex.(*QueryLex).checkFunction($1)
+				if $10.Before($8) {
+					Querylex.(*QueryLex).Error(fmt.Sprintf("the window of changed(%s) ends before it starts", $3))
+				}
+				$5.Key = $3
+				$5.Start = $8
+				$5.End = $10
+				$$ = $5
 			}
 			;
 
+changeValues	: /* any values */
+				{
+					$$ = TransitionTerm{}
+				}
+				| LVALUE QSTRING
+				{
+					Querylex.(*QueryLex).expectWord($1, "from")
+					$$ = TransitionTerm{From: $2}
+				}
+				| TO QSTRING
+				{
+					$$ = TransitionTerm{To: $2}
+				}
+				| LVALUE QSTRING TO QSTRING
+				{
+					Querylex.(*QueryLex).expectWord($1, "from")
+					$$ = TransitionTerm{From: $2, To: $4}
+				}
+				;
+
 timeTerm	:	HAPPENS IN LPAREN timeref COMMA timeref RPAREN
 			{
 				template := `select uuid, dkey, timestamp as maxtime from data
 				where timestamp >= "%s" and timestamp < "%s"
 				order by timestamp desc`
-				$$ = fmt.Sprintf(template, $4.Format(_time.RFC3339), $6.Format(_time.RFC3339))
+				$$.SQL = fmt.Sprintf(template, SQLTime($4), SQLTime($6))
+				$$.Description = fmt.Sprintf("any value set in [%s, %s)", $4.Format(_time.RFC3339Nano), $6.Format(_time.RFC3339Nano))
 			}
 			|	HAPPENS BEFORE timeref
 			{
 				template := `select uuid, dkey, timestamp as maxtime from data
 				where timestamp <  "%s"
 				order by timestamp desc`
-				$$ = fmt.Sprintf(template, $3.Format(_time.RFC3339))
+				$$.SQL = fmt.Sprintf(template, SQLTime($3))
+				$$.Description = fmt.Sprintf("any value set before %s", $3.Format(_time.RFC3339Nano))
 			}
 			|	AT timeref
 			{
 				template := `select distinct uuid, dkey, max(timestamp) as maxtime from data
 				where timestamp <= "%s"
 				group by dkey, uuid order by timestamp desc`
-				$$ = fmt.Sprintf(template, $2.Format(_time.RFC3339))
+				$$.SQL = fmt.Sprintf(template, SQLTime($2))
+				$$.Description = fmt.Sprintf("value at %s", $2.Format(_time.RFC3339Nano))
+				$$.At = $2
 			}
 			|	HAPPENS AFTER timeref
 			{
 				template := `select uuid, dkey, timestamp as maxtime from data
 				where timestamp >= "%s"
 				order by timestamp desc`
-				$$ = fmt.Sprintf(template, $3.Format(_time.RFC3339))
+				$$.SQL = fmt.Sprintf(template, SQLTime($3))
+				$$.Description = fmt.Sprintf("any value set at or after %s", $3.Format(_time.RFC3339Nano))
+			}
+			|	FOR AT LVALUE reltime IN LPAREN timeref COMMA timeref RPAREN
+			{
+				Querylex.(*QueryLex).expectWord($3, "least")
+				atLeast, err := $4.fixed()
+				if err != nil {
+					Querylex.(*QueryLex).Error(err.Error())
+				}
+				$$.Duration = &DurationTerm{AtLeast: atLeast, Start: $7, End: Querylex.(*QueryLex).windowEnd($9)}
+				$$.Description = fmt.Sprintf("true for at least %v in [%s, %s)", atLeast, $7.Format(_time.RFC3339Nano), $9.Format(_time.RFC3339Nano))
 			}
 			|	FOR LPAREN timeref COMMA timeref RPAREN
 			{
 				template := `select uuid, dkey, timestamp as maxtime from data
 				where timestamp >= "%s" and timestamp < "%s"
 				order by timestamp desc`
-				$$ = fmt.Sprintf(template, $3.Format(_time.RFC3339), $5.Format(_time.RFC3339))
+				$$.SQL = fmt.Sprintf(template, SQLTime($3), SQLTime($5))
+				$$.Description = fmt.Sprintf("any value set in [%s, %s)", $3.Format(_time.RFC3339Nano), $5.Format(_time.RFC3339Nano))
 			}
 			;
 
@@ -310,11 +503,22 @@ timeref		: abstime
 			}
 			| abstime reltime
 			{
-				$$ = $1.Add($2)
+				$$ = $2.addTo($1, Querylex.(*QueryLex).Location)
 			}
 			;
 
-abstime		: NUMBER LVALUE
+abstime		: timevalue
+			{
+				$$ = $1
+			}
+			| LVALUE
+			{
+				$$ = Querylex.(*QueryLex).eventTime($1)
+			}
+			;
+
+/* an absolute time other than a reference to an event */
+timevalue	: NUMBER LVALUE
 			{
 				foundtime, err := parseAbsTime($1, $2)
 				if err != nil {
@@ -324,27 +528,19 @@ abstime		: NUMBER LVALUE
 			}
 			| NUMBER
 			{
-				num, err := strconv.ParseInt($1, 10, 64)
+				t, err := parseUnixTime($1)
 				if err != nil {
-					Querylex.(*QueryLex).Error(fmt.Sprintf("Could not parse integer \"%v\" (%v)", $1, err.Error()))
+					Querylex.(*QueryLex).Error(fmt.Sprintf("Could not parse time \"%v\" (%v)", $1, err.Error()))
 				}
-				$$ = _time.Unix(num, 0)
+				$$ = t
 			}
 			| QSTRING
 			{
-				found := false
-				for _, format := range supported_formats {
-					t, err := _time.Parse(format, $1)
-					if err != nil {
-						continue
-					}
-					$$ = t
-					found = true
-					break
-				}
-				if !found {
-					Querylex.(*QueryLex).Error(fmt.Sprintf("No time format matching \"%v\" found", $1))
+				t, err := parseTimeLiteral($1, Querylex.(*QueryLex).Location)
+				if err != nil {
+					Querylex.(*QueryLex).Error(err.Error())
 				}
+				$$ = t
 			}
 			| NOW
 			{
@@ -352,23 +548,27 @@ abstime		: NUMBER LVALUE
 				Querylex.(*QueryLex).Query.Now = now
 				$$ = now
 			}
+			| LVALUE LPAREN LVALUE COMMA timeref RPAREN
+			{
+				$$ = Querylex.(*QueryLex).startOf($1, $3, $5)
+			}
 			;
 
 reltime		: NUMBER LVALUE
 			{
 				var err error
-				$$, err = parseReltime($1, $2)
+				$$, err = parseRelTime($1, $2)
 				if err != nil {
 					Querylex.(*QueryLex).Error(fmt.Sprintf("Error parsing relative time \"%v %v\" (%v)", $1, $2, err.Error()))
 				}
 			}
 			| NUMBER LVALUE reltime
 			{
-				newDuration, err := parseReltime($1, $2)
+				newDuration, err := parseRelTime($1, $2)
 				if err != nil {
 					Querylex.(*QueryLex).Error(fmt.Sprintf("Error parsing relative time \"%v %v\" (%v)", $1, $2, err.Error()))
 				}
-				$$ = addDurations(newDuration, $3)
+				$$ = newDuration.add($3)
 			}
 			;
 %%
@@ -384,6 +584,8 @@ const (
 	t_IBEFORE SelectPredicate = IBEFORE
 	t_BEFORE SelectPredicate = BEFORE
 	t_BETWEEN SelectPredicate = BETWEEN
+	t_DIFF SelectPredicate = DIFF
+	t_DURATION SelectPredicate = DURATION
 )
 
 const eof = 0
@@ -395,14 +597,35 @@ var supported_formats = []string{"1/2/2006",
 								 "1-2-2006 15:04:05 MST",
 								 "2006-1-2 15:04:05 MST"}
 type QueryLex struct {
+	// the statement currently being parsed
 	Query	*Query
+	// the completely parsed statements, in order
+	Queries	[]*Query
 	querystring   string
 	scanner *toki.Scanner
 	lasttoken string
+	// position and text of the most recently lexed token
+	lastpos	toki.Position
+	lastvalue	string
 	tokens	[]string
 	innertable	int
+	// the first error encountered; a *QueryError
 	Err   error
 	Now		_time.Time
+	// the named events that times may refer to, including those defined by
+	// earlier statements of the query
+	Events	map[string]Event
+	// the time zone of time literals without one, and of calendar units.
+	// Changed by "set timezone" for the following statements
+	Location	*_time.Location
+}
+
+// Finishes the statement currently being parsed and starts a new one
+func (ql *QueryLex) EndStatement() {
+	ql.Queries = append(ql.Queries, ql.Query)
+	ql.Query = &Query{}
+	// table names only need to be unique within a statement
+	ql.innertable = 0
 }
 
 func (ql *QueryLex) NextLetter() string {
@@ -454,45 +677,50 @@ var timePredicateRange = `
 `
 
 func NewQueryLexer(s string) *QueryLex {
+	// the scanner returns the first definition that matches, so keywords end
+	// at a word boundary: names such as "inspection" or "settings" are
+	// LVALUEs rather than a keyword followed by the rest of the name
 	scanner := toki.NewScanner(
 		[]toki.Def{
-			{Token: WHERE, Pattern: "where"},
-			{Token: SELECT, Pattern: "select"},
-			{Token: DISTINCT, Pattern: "distinct"},
+			{Token: EXPLAIN, Pattern: "explain\\b"},
+			{Token: WHERE, Pattern: "where\\b"},
+			{Token: SELECT, Pattern: "select\\b"},
+			{Token: DISTINCT, Pattern: "distinct\\b"},
 			{Token: ALL, Pattern: "\\*"},
-			{Token: NOW, Pattern: "now"},
-			{Token: SET, Pattern: "set"},
-			{Token: BEFORE, Pattern: "before"},
-			{Token: FIRST, Pattern: "first"},
-			{Token: LAST, Pattern: "last"},
-			{Token: IBEFORE, Pattern: "ibefore"},
-			{Token: BETWEEN, Pattern: "between"},
-			{Token: HAPPENS, Pattern: "happens"},
-			{Token: AT, Pattern: "at"},
-			{Token: AFTER, Pattern: "after"},
-			{Token: IAFTER, Pattern: "iafter"},
+			{Token: NOW, Pattern: "now\\b"},
+			{Token: SET, Pattern: "set\\b"},
+			{Token: BEFORE, Pattern: "before\\b"},
+			{Token: FIRST, Pattern: "first\\b"},
+			{Token: LAST, Pattern: "last\\b"},
+			{Token: IBEFORE, Pattern: "ibefore\\b"},
+			{Token: BETWEEN, Pattern: "between\\b"},
+			{Token: HAPPENS, Pattern: "happens\\b"},
+			{Token: AT, Pattern: "at\\b"},
+			{Token: AFTER, Pattern: "after\\b"},
+			{Token: IAFTER, Pattern: "iafter\\b"},
 			{Token: COMMA, Pattern: ","},
-			{Token: AND, Pattern: "and"},
-			{Token: AS, Pattern: "as"},
-			{Token: TO, Pattern: "to"},
-			{Token: FOR, Pattern: "for"},
-			{Token: OR, Pattern: "or"},
-			{Token: IN, Pattern: "in"},
-			{Token: HAS, Pattern: "has"},
-			{Token: NOT, Pattern: "not"},
+			{Token: AND, Pattern: "and\\b"},
+			{Token: AS, Pattern: "as\\b"},
+			{Token: TO, Pattern: "to\\b"},
+			{Token: FOR, Pattern: "for\\b"},
+			{Token: OR, Pattern: "or\\b"},
+			{Token: IN, Pattern: "in\\b"},
+			{Token: HAS, Pattern: "has\\b"},
+			{Token: NOT, Pattern: "not\\b"},
 			{Token: NEQ, Pattern: "!="},
+			{Token: ARROW, Pattern: "->"},
 			{Token: EQ, Pattern: "="},
 			{Token: LPAREN, Pattern: "\\("},
 			{Token: RPAREN, Pattern: "\\)"},
 			{Token: SEMICOLON, Pattern: ";"},
 			{Token: NEWLINE, Pattern: "\n"},
-			{Token: LIKE, Pattern: "(like)|~"},
+			{Token: LIKE, Pattern: "(like\\b)|~"},
 			{Token: NUMBER, Pattern: "([+-]?([0-9]*\\.)?[0-9]+)"},
-			{Token: LVALUE, Pattern: "[a-zA-Z\\~\\$\\_][a-zA-Z0-9\\/\\%_\\-]*"},
+			{Token: LVALUE, Pattern: "[a-zA-Z\\~\\$\\_][a-zA-Z0-9\\/\\%_\\-\\.]*"},
 			{Token: QSTRING, Pattern: "(\"[^\"\\\\]*?(\\.[^\"\\\\]*?)*?\")|('[^'\\\\]*?(\\.[^'\\\\]*?)*?')"},
 		})
 	scanner.SetInput(s)
-	lex := &QueryLex{Query: &Query{}, Now: _time.Now(), querystring: s, scanner: scanner, Err: nil, lasttoken: "", tokens: []string{}}
+	lex := &QueryLex{Query: &Query{}, Now: _time.Now(), querystring: s, scanner: scanner, Err: nil, lasttoken: "", tokens: []string{}, Location: _time.UTC}
 	//lex.Rewrite(s)
 	return lex
 }
@@ -513,7 +741,16 @@ func (lex *QueryLex) Rewrite(s string) {
 func (lex *QueryLex) Lex(lval *QuerySymType) int {
 	r := lex.scanner.Next()
 	lex.lasttoken = r.String()
-	if r.Pos.Line == 2 || len(r.Value) == 0 {
+	lex.lastpos = r.Pos
+	lex.lastvalue = string(r.Value)
+	if r.Token == toki.Error {
+		if lex.Err == nil {
+			token := lex.unrecognized(r.Pos)
+			lex.Err = NewQueryError(LexError, fmt.Sprintf("unrecognized input %q", token), lex.querystring, r.Pos.Line, r.Pos.Column, token)
+		}
+		return eof
+	}
+	if len(r.Value) == 0 {
 		return eof
 	}
 	lval.str = string(r.Value)
@@ -521,8 +758,233 @@ func (lex *QueryLex) Lex(lval *QuerySymType) int {
 	return int(r.Token)
 }
 
+// Records an error at the most recently lexed token. Only the first error is
+// kept, because later errors are usually caused by it
 func (lex *QueryLex) Error(s string) {
-	lex.Err = fmt.Errorf(s)
+	if lex.Err != nil {
+		return
+	}
+	lex.Err = newSyntaxError(s, lex.querystring, lex.lastpos.Line, lex.lastpos.Column, lex.lastvalue)
+}
+
+// Returns the end of a window over the history, which cannot be later than
+// the time of the query: values are only known to hold until now
+func (lex *QueryLex) windowEnd(end _time.Time) _time.Time {
+	if end.After(lex.Now) {
+		return lex.Now
+	}
+	return end
+}
+
+// Records an error unless name is a predicate that takes a key, written like
+// a function call: changed(Key)
+func (lex *QueryLex) checkFunction(name string) {
+	if name != "changed" {
+		lex.Error(fmt.Sprintf("unknown predicate %s(), expecting changed()", name))
+	}
+}
+
+// Records an error unless a word that is not a keyword, so that it can still
+// be used as a key, is the one the grammar expects at this point
+func (lex *QueryLex) expectWord(word, expected string) {
+	if word != expected {
+		lex.Error(fmt.Sprintf("unexpected %s, expecting %s", word, expected))
+	}
+}
+
+// An argument of a function in a select term: a bare name, which stands for
+// a key or an event depending on the function, or a time
+type funcArg struct {
+	name   string
+	time   _time.Time
+	isTime bool
+}
+
+// Returns the select term written as a function call without limits:
+// diff(t0, t1), or traverse(keys...) downstream to any depth
+func (lex *QueryLex) function(name string, args []funcArg) SelectTerm {
+	switch name {
+	case "diff":
+		if len(args) != 2 {
+			lex.Error(fmt.Sprintf("diff() takes 2 times, got %d", len(args)))
+			return SelectTerm{Filter: DIFF}
+		}
+		return SelectTerm{Filter: DIFF, StartTime: lex.argTime(args[0]), EndTime: lex.argTime(args[1])}
+	case "duration":
+		lex.Error("duration() needs a window: duration(Key) in (t0, t1)")
+		return SelectTerm{Filter: DURATION}
+	case "traverse":
+		return lex.traversal(name, args, TraversalTerm{})
+	}
+	lex.Error(fmt.Sprintf("unknown function %s(), expecting diff(), duration() or traverse()", name))
+	return SelectTerm{}
+}
+
+// Returns the select term duration(Key) in (start, end), the time the key
+// held each of its values during the window
+func (lex *QueryLex) duration(name string, args []funcArg, start, end _time.Time) SelectTerm {
+	if name != "duration" {
+		lex.Error(fmt.Sprintf("unknown function %s(), expecting duration()", name))
+		return SelectTerm{}
+	}
+	if len(args) != 1 || args[0].isTime {
+		lex.Error("duration() takes a single key")
+		return SelectTerm{Filter: DURATION}
+	}
+	return SelectTerm{Tag: args[0].name, Filter: DURATION, StartTime: start, EndTime: lex.windowEnd(end)}
+}
+
+// Returns the time an argument stands for: a bare name is an event
+func (lex *QueryLex) argTime(arg funcArg) _time.Time {
+	if arg.isTime {
+		return arg.time
+	}
+	return lex.eventTime(arg.name)
+}
+
+// Records the traversal written as name(keys...) followed by its limits,
+// recording an error unless name is traverse. The traversal replaces the
+// select terms of the statement, so the returned term is only a placeholder
+func (lex *QueryLex) traversal(name string, args []funcArg, limits TraversalTerm) SelectTerm {
+	if name != "traverse" {
+		lex.Error(fmt.Sprintf("unknown function %s(), expecting traverse()", name))
+		return SelectTerm{}
+	}
+	for _, arg := range args {
+		if arg.isTime {
+			lex.Error("traverse() takes keys, not times")
+			return SelectTerm{}
+		}
+		limits.Keys = append(limits.Keys, arg.name)
+	}
+	lex.Query.Traversal = &limits
+	return SelectTerm{}
+}
+
+// Sets the select terms of the current statement. A traversal is written as
+// a select term but returns documents rather than values, so it must be the
+// only one
+func (lex *QueryLex) setSelects(terms []SelectTerm) {
+	if lex.Query.Traversal == nil {
+		lex.Query.Selects = terms
+	} else if len(terms) > 1 {
+		lex.Error("traverse() cannot be combined with other select terms")
+	}
+}
+
+// Returns a traversal in the direction written as "downstream" or "upstream"
+func (lex *QueryLex) traversalDirection(direction string) TraversalTerm {
+	switch direction {
+	case "downstream":
+		return TraversalTerm{}
+	case "upstream":
+		return TraversalTerm{Upstream: true}
+	}
+	lex.Error(fmt.Sprintf("unknown traversal direction %q, expecting downstream or upstream", direction))
+	return TraversalTerm{}
+}
+
+// Returns the depth written as "depth <n>", which must be a positive integer
+func (lex *QueryLex) traversalDepth(word, number string) int {
+	if word != "depth" {
+		lex.Error(fmt.Sprintf("unexpected %s, expecting depth <n>", word))
+		return 0
+	}
+	depth, err := strconv.Atoi(number)
+	if err != nil || depth < 1 {
+		lex.Error(fmt.Sprintf("invalid traversal depth %s, expecting a positive integer", number))
+		return 0
+	}
+	return depth
+}
+
+// Records the definition of an event by the current statement. Later
+// statements may refer to it
+func (lex *QueryLex) defineEvent(name string, start, end _time.Time) {
+	if strings.Contains(name, ".") {
+		lex.Error(fmt.Sprintf("invalid event name %q (names cannot contain '.')", name))
+		return
+	}
+	if end.Before(start) {
+		lex.Error(fmt.Sprintf("event %s ends before it starts", name))
+		return
+	}
+	event := Event{Name: name, Start: start, End: end}
+	lex.Query.Define = &event
+	if lex.Events == nil {
+		lex.Events = map[string]Event{}
+	}
+	lex.Events[name] = event
+}
+
+// Returns the time an event reference such as "sag1.start" or "sag1.end"
+// stands for. A bare name stands for the start of the event
+func (lex *QueryLex) eventTime(ref string) _time.Time {
+	name, field := ref, "start"
+	if idx := strings.LastIndex(ref, "."); idx >= 0 {
+		name, field = ref[:idx], ref[idx+1:]
+	}
+	event, found := lex.Events[name]
+	if !found {
+		lex.Error(fmt.Sprintf("unknown event %q", name))
+		return _time.Time{}
+	}
+	switch field {
+	case "start":
+		return event.Start
+	case "end":
+		return event.End
+	}
+	lex.Error(fmt.Sprintf("unknown event time %q, expecting %s.start or %s.end", ref, name, name))
+	return _time.Time{}
+}
+
+// Sets the time zone of the following statements, which is an IANA name
+// such as "America/Los_Angeles", "UTC" or "Local"
+func (lex *QueryLex) setTimezone(quoted string) {
+	name := strings.Trim(quoted, "\"'")
+	loc, err := _time.LoadLocation(name)
+	if err != nil {
+		lex.Error(fmt.Sprintf("unknown time zone %q", name))
+		return
+	}
+	lex.Location = loc
+	lex.Query.Timezone = loc
+}
+
+// Returns the start of the calendar unit containing t in the time zone of
+// the query: startof(day, now)
+func (lex *QueryLex) startOf(name, unit string, t _time.Time) _time.Time {
+	if name != "startof" {
+		lex.Error(fmt.Sprintf("unknown function %s(), expecting startof()", name))
+		return t
+	}
+	start, err := startOf(unit, t, lex.Location)
+	if err != nil {
+		lex.Error(err.Error())
+	}
+	return start
+}
+
+// Records an error if the term is a join with a time predicate other than
+// "at <time>": the link and the document it refers to must be resolved at
+// the same instant
+func (lex *QueryLex) checkJoin(term WhereTerm, tt TimeTerm) {
+	if term.Link != "" && tt.At.IsZero() {
+		lex.Error(fmt.Sprintf("%s -> can only be evaluated at a single time (at <time>)", term.Link))
+	}
+}
+
+// returns the run of non-whitespace text at the given position of the query
+func (lex *QueryLex) unrecognized(pos toki.Position) string {
+	lines := strings.Split(lex.querystring, "\n")
+	if pos.Line < 1 || pos.Line > len(lines) || pos.Column < 1 || pos.Column > len(lines[pos.Line-1]) {
+		return ""
+	}
+	if fields := strings.Fields(lines[pos.Line-1][pos.Column-1:]); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
 }
 
 func readline(fi *bufio.Reader) (string, bool) {
@@ -1,8 +1,10 @@
-//go:generate go tool yacc -o query.go -p Query query.y
+//go:generate goyacc -o query.go -p Query query.y
 package query
 
 import (
+	"bytes"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -11,6 +13,58 @@ type Query struct {
 	Wheres  WhereClause
 	SQL     string
 	Now     time.Time
+	// if true, the query is described rather than evaluated
+	Explain bool
+	// the changed(Key) terms of the WHERE clause, whose transitions are
+	// returned with the matching documents
+	Transitions []TransitionTerm
+	// set instead of Selects for statements that define an event
+	Define *Event
+	// set instead of Selects for "set timezone" statements
+	Timezone *time.Location
+	// set instead of Selects for statements that select a traversal from
+	// each matching document
+	Traversal *TraversalTerm
+}
+
+// A traverse(Key, ...) select term, which follows the references to other
+// documents held in the keys from each matching document: "select
+// traverse(Equipment/AHU, Equipment/VAV) downstream depth 2 at now where ..."
+type TraversalTerm struct {
+	// the keys that hold references
+	Keys []string
+	// if true, references are followed from a document to the documents its
+	// keys refer to, rather than to the documents that refer to it
+	Upstream bool
+	// the largest number of references followed, or 0 for no limit
+	Depth int
+	// the time at which the references and documents are resolved, or zero
+	// for their current versions
+	At time.Time
+}
+
+// Returns the traversal as it would be written in a query
+func (tt TraversalTerm) String() string {
+	s := fmt.Sprintf("traverse(%s) downstream", strings.Join(tt.Keys, ", "))
+	if tt.Upstream {
+		s = fmt.Sprintf("traverse(%s) upstream", strings.Join(tt.Keys, ", "))
+	}
+	if tt.Depth > 0 {
+		s += fmt.Sprintf(" depth %d", tt.Depth)
+	}
+	if !tt.At.IsZero() {
+		s += " at " + tt.At.Format(time.RFC3339Nano)
+	}
+	return s
+}
+
+// A named interval, defined with "define event <name> in (start, end)", to
+// which times in queries may refer as <name>.start and <name>.end. Events
+// defined at a single time start and end at that time
+type Event struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
 }
 
 type SelectTerm struct {
@@ -20,6 +74,52 @@ type SelectTerm struct {
 	EndTime   time.Time
 }
 
+// Returns the select term as it would be written in a query
+func (st SelectTerm) String() string {
+	if st.Filter == DIFF {
+		return fmt.Sprintf("diff(%s, %s)", st.StartTime.Format(time.RFC3339Nano), st.EndTime.Format(time.RFC3339Nano))
+	}
+	tag := st.Tag
+	if tag == "" {
+		tag = "*"
+	}
+	switch st.Filter {
+	case FIRST:
+		return "first " + tag
+	case LAST:
+		return "last " + tag
+	case ALL:
+		return "all " + tag
+	case AT:
+		return fmt.Sprintf("%s at %s", tag, st.StartTime.Format(time.RFC3339Nano))
+	case IAFTER:
+		return fmt.Sprintf("%s iafter %s", tag, st.StartTime.Format(time.RFC3339Nano))
+	case AFTER:
+		return fmt.Sprintf("%s after %s", tag, st.StartTime.Format(time.RFC3339Nano))
+	case IBEFORE:
+		return fmt.Sprintf("%s ibefore %s", tag, st.StartTime.Format(time.RFC3339Nano))
+	case BEFORE:
+		return fmt.Sprintf("%s before %s", tag, st.StartTime.Format(time.RFC3339Nano))
+	case BETWEEN:
+		return fmt.Sprintf("%s between %s, %s", tag, st.StartTime.Format(time.RFC3339Nano), st.EndTime.Format(time.RFC3339Nano))
+	case DURATION:
+		return fmt.Sprintf("duration(%s) in (%s, %s)", tag, st.StartTime.Format(time.RFC3339Nano), st.EndTime.Format(time.RFC3339Nano))
+	}
+	return tag
+}
+
+// Returns the diff(t0, t1) term of the select clause, if there is one. Such a
+// query returns how each matching document changed between the two times
+// rather than the documents themselves
+func (q *Query) Diff() (SelectTerm, bool) {
+	for _, term := range q.Selects {
+		if term.Filter == DIFF {
+			return term, true
+		}
+	}
+	return SelectTerm{}, false
+}
+
 type WhereTerm struct {
 	Key         string
 	Op          string
@@ -27,9 +127,37 @@ type WhereTerm struct {
 	SQL         string
 	Letter      string
 	IsPredicate bool
+	// for a parenthesized term, the parsed clause inside the parens
+	Node *WhereNode
+	// for a join (Link -> Key ...), the key of the matching documents whose
+	// value is the UUID of the document the predicate is evaluated against
+	Link string
+}
+
+// the temporal semantics of a term without a time predicate
+const latestDescription = "most recent value"
+
+// Returns the node describing the term, evaluated with the given temporal
+// semantics. Parenthesized terms keep the semantics of their inner terms
+func (wt WhereTerm) NodeWithTime(description string) *WhereNode {
+	if !wt.IsPredicate {
+		return wt.Node
+	}
+	op := strings.ToLower(wt.Op)
+	if op == "~" {
+		op = "like"
+	}
+	key := wt.Key
+	if wt.Link != "" {
+		key = wt.Link + " -> " + key
+	}
+	return &WhereNode{Op: op, Key: key, Val: wt.Val, Time: description}
 }
 
 func (wt WhereTerm) GetClause() WhereClause {
+	if wt.Link != "" {
+		return WrapTermInJoin(wt.Link, wt.SQL, wt.Letter, time.Time{})
+	}
 	if wt.IsPredicate {
 		return WrapTermInSelect(wt.SQL, wt.Letter)
 	} else {
@@ -37,9 +165,12 @@ func (wt WhereTerm) GetClause() WhereClause {
 	}
 }
 
-func (wt WhereTerm) GetClauseWithTime(inner string) WhereClause {
+func (wt WhereTerm) GetClauseWithTime(tt TimeTerm) WhereClause {
+	if wt.Link != "" {
+		return WrapTermInJoin(wt.Link, wt.SQL, wt.Letter, tt.At)
+	}
 	if wt.IsPredicate {
-		return WrapTermInSelectWithTime(wt.SQL, wt.Letter, inner)
+		return tt.Wrap(wt.SQL, wt.Letter)
 	} else {
 		return WhereClause{SQL: wt.SQL, Letter: wt.Letter}
 	}
@@ -48,19 +179,213 @@ func (wt WhereTerm) GetClauseWithTime(inner string) WhereClause {
 type WhereClause struct {
 	SQL    string
 	Letter string
+	// the parsed form of the clause, used by EXPLAIN
+	Node *WhereNode
+}
+
+// A node in the parsed WHERE clause. Nodes with Op "and", "or" or "not"
+// combine their children; any other Op ("=", "!=", "like", "has") is a
+// predicate on a single key
+type WhereNode struct {
+	Op  string `json:"op"`
+	Key string `json:"key,omitempty"`
+	Val string `json:"value,omitempty"`
+	// which values of the key the predicate is evaluated against
+	Time     string       `json:"time,omitempty"`
+	Children []*WhereNode `json:"children,omitempty"`
+}
+
+// Returns the node as an indented tree, one node per line
+func (wn *WhereNode) String() string {
+	var buf bytes.Buffer
+	wn.write(&buf, 0)
+	return buf.String()
+}
+
+func (wn *WhereNode) write(buf *bytes.Buffer, depth int) {
+	if wn == nil {
+		return
+	}
+	buf.WriteString(strings.Repeat("  ", depth))
+	switch wn.Op {
+	case "and", "or", "not":
+		buf.WriteString(wn.Op)
+	case "has":
+		fmt.Fprintf(buf, "has %s (%s)", wn.Key, wn.Time)
+	case "changed":
+		fmt.Fprintf(buf, "changed(%s)%s (%s)", wn.Key, wn.Val, wn.Time)
+	default:
+		fmt.Fprintf(buf, "%s %s %s (%s)", wn.Key, wn.Op, wn.Val, wn.Time)
+	}
+	buf.WriteString("\n")
+	for _, child := range wn.Children {
+		child.write(buf, depth+1)
+	}
+}
+
+// A time predicate on a WHERE term
+type TimeTerm struct {
+	// selects the (uuid, dkey, maxtime) rows the term is evaluated against
+	SQL string
+	// describes the temporal semantics for EXPLAIN
+	Description string
+	// set instead of SQL for predicates on how long the term held
+	Duration *DurationTerm
+	// the time of an "at <time>" predicate, which joins are evaluated at
+	At time.Time
+}
+
+// Returns the clause matching documents for which the term (the SQL of a
+// predicate on data) holds with these temporal semantics
+func (tt TimeTerm) Wrap(where, letter string) WhereClause {
+	if tt.Duration != nil {
+		return WrapTermInDuration(where, letter, *tt.Duration)
+	}
+	return WrapTermInSelectWithTime(where, letter, tt.SQL)
+}
+
+// A "for at least <duration> in (start, end)" time predicate: the term held
+// for a total of at least AtLeast within [Start, End)
+type DurationTerm struct {
+	AtLeast time.Duration
+	Start   time.Time
+	End     time.Time
+}
+
+// layout of MySQL datetime literals with microsecond precision. Connections
+// to the backend use UTC as their time zone
+const SQLTimeFormat = "2006-01-02 15:04:05.000000"
+
+// Returns the MySQL datetime literal of the time, without quotes
+func SQLTime(t time.Time) string {
+	return t.UTC().Format(SQLTimeFormat)
+}
+
+// the (uuid, dkey, dval, began, ended) of each row of data matching the
+// condition: the part [began, ended) of [start, end) in which it was the value
+// of its key. ended is not after began for rows that were replaced before
+// start. The row that replaced each one is found by joining the matching rows
+// with the later rows of the same key before end, rather than with a
+// subquery per row or window functions, which older MySQL versions lack
+var intervalsTemplate = `
+        select data.uuid, data.dkey, data.dval,
+        greatest(data.timestamp, cast("%[1]s" as datetime(6))) as began,
+        least(coalesce(min(following.timestamp), cast("%[2]s" as datetime(6))), cast("%[2]s" as datetime(6))) as ended
+        from data
+        left join data as following
+        on following.uuid = data.uuid and following.dkey = data.dkey and
+        following.timestamp > data.timestamp and following.timestamp < "%[2]s"
+        where data.dval is not null and data.timestamp < "%[2]s" and
+        %[3]s
+        group by data.uuid, data.dkey, data.dval, data.timestamp`
+
+func intervalsSQL(where string, start, end time.Time) string {
+	return fmt.Sprintf(intervalsTemplate, SQLTime(start), SQLTime(end), where)
+}
+
+func WrapTermInDuration(where, letter string, dt DurationTerm) WhereClause {
+	sql := fmt.Sprintf(`
+    (
+    select intervals.uuid
+    from
+    (%s
+    ) as intervals
+    where intervals.ended > intervals.began
+    group by intervals.uuid
+    having sum(timestampdiff(microsecond, intervals.began, intervals.ended)) >= %d)`, intervalsSQL(where, dt.Start, dt.End), dt.AtLeast/time.Microsecond)
+	return WhereClause{SQL: sql, Letter: letter}
+}
+
+// Returns a query for the (uuid, dval, microseconds) of the total time each
+// value of the key of a duration(Key) select term was in effect within its
+// window. filter is an additional condition on the rows of data, e.g.
+// "data.uuid = ?"
+func (st SelectTerm) DurationSQL(filter string) string {
+	where := fmt.Sprintf(`data.dkey = "%s"`, st.Tag)
+	if filter != "" {
+		where += " and " + filter
+	}
+	return fmt.Sprintf(`
+select intervals.uuid, intervals.dval, sum(timestampdiff(microsecond, intervals.began, intervals.ended))
+from
+(%s
+) as intervals
+where intervals.ended > intervals.began
+group by intervals.uuid, intervals.dval`, intervalsSQL(where, st.StartTime, st.EndTime))
+}
+
+// A changed(Key) term, which matches documents whose key changed from one
+// value to a different one. Setting a key that was never set and removing a
+// key are not changes; setting a removed key is a change from the value it had
+// before it was removed, if different
+type TransitionTerm struct {
+	Key string
+	// the quoted values the key changed from and to; empty matches any value
+	From string
+	To   string
+	// the change happened in [Start, End); zero times match any time
+	Start time.Time
+	End   time.Time
+}
+
+// the (uuid, dkey, oldval, newval, timestamp) of each change of a key. The
+// previous value of each edit is the last value the key had before it, even
+// if the key was removed in between, and is found through the (uuid, dkey,
+// timestamp) index rather than with window functions, which older MySQL
+// versions lack
+var transitionsTemplate = `
+select uuid, dkey, oldval, newval, timestamp from (
+    select cur.uuid, cur.dkey, cur.dval as newval, cur.timestamp,
+    (
+        select prev.dval from data as prev
+        where prev.uuid = cur.uuid and prev.dkey = cur.dkey and prev.timestamp < cur.timestamp and prev.dval is not null
+        order by prev.timestamp desc limit 1
+    ) as oldval
+    from data as cur
+    where cur.dkey = "%s" and cur.dval is not null%s
+) as changes
+where oldval is not null and oldval != newval%s`
+
+// Returns a query for the (uuid, dkey, oldval, newval, timestamp) of each
+// change the term matches. filter is an additional condition on the changed
+// row, e.g. "cur.uuid = ?"
+func (tt TransitionTerm) SQL(filter string) string {
+	var inner, outer string
+	if !tt.Start.IsZero() {
+		inner += fmt.Sprintf(` and cur.timestamp >= "%s" and cur.timestamp < "%s"`, SQLTime(tt.Start), SQLTime(tt.End))
+	}
+	if filter != "" {
+		inner += " and " + filter
+	}
+	if tt.From != "" {
+		outer += fmt.Sprintf(` and oldval = %s`, tt.From)
+	}
+	if tt.To != "" {
+		outer += fmt.Sprintf(` and newval = %s`, tt.To)
+	}
+	return fmt.Sprintf(transitionsTemplate, tt.Key, inner, outer)
+}
+
+// Returns the node describing the term for EXPLAIN
+func (tt TransitionTerm) Node() *WhereNode {
+	node := &WhereNode{Op: "changed", Key: tt.Key, Time: "any change"}
+	if tt.From != "" {
+		node.Val += " from " + tt.From
+	}
+	if tt.To != "" {
+		node.Val += " to " + tt.To
+	}
+	if !tt.Start.IsZero() {
+		node.Time = fmt.Sprintf("changed in [%s, %s)", tt.Start.Format(time.RFC3339Nano), tt.End.Format(time.RFC3339Nano))
+	}
+	return node
 }
 
 func WrapTermInSelect(where, letter string) WhereClause {
 	sql := fmt.Sprintf(`
     (
     select distinct data.uuid
-    from data
-    inner join
-    (
-        select distinct uuid, dkey, max(timestamp) as maxtime from data
-        group by dkey, uuid order by timestamp desc
-    ) sorted
-    on data.uuid = sorted.uuid and data.dkey = sorted.dkey and data.timestamp = sorted.maxtime
+    from current as data
     where data.dval is not null and
     %s)`, where)
 	return WhereClause{SQL: sql, Letter: letter}
@@ -81,6 +406,50 @@ func WrapTermInSelectWithTime(where, letter, inner string) WhereClause {
 	return WhereClause{SQL: sql, Letter: letter}
 }
 
+// the documents whose link key refers to a document matching the condition,
+// with both resolved at the same time. %[3]s is the time
+var joinAtTemplate = `
+    (
+    select distinct link.uuid
+    from data as link
+    inner join
+    (
+        select uuid, dkey, max(timestamp) as maxtime from data
+        where dkey = "%[1]s" and timestamp <= "%[3]s"
+        group by uuid, dkey
+    ) linked
+    on link.uuid = linked.uuid and link.dkey = linked.dkey and link.timestamp = linked.maxtime
+    inner join data
+    on data.uuid = link.dval
+    inner join
+    (
+        select uuid, dkey, max(timestamp) as maxtime from data
+        where timestamp <= "%[3]s"
+        group by uuid, dkey
+    ) sorted
+    on data.uuid = sorted.uuid and data.dkey = sorted.dkey and data.timestamp = sorted.maxtime
+    where link.dval is not null and data.dval is not null and
+    %[2]s)`
+
+// Returns the clause matching documents whose link key holds the UUID of a
+// document for which the condition holds. Both the link and the referenced
+// document are resolved at the given time, or at their current versions if
+// it is zero
+func WrapTermInJoin(link, where, letter string, at time.Time) WhereClause {
+	if !at.IsZero() {
+		return WhereClause{SQL: fmt.Sprintf(joinAtTemplate, link, where, SQLTime(at)), Letter: letter}
+	}
+	sql := fmt.Sprintf(`
+    (
+    select distinct link.uuid
+    from current as link
+    inner join current as data
+    on data.uuid = link.dval
+    where link.dkey = "%s" and link.dval is not null and data.dval is not null and
+    %s)`, link, where)
+	return WhereClause{SQL: sql, Letter: letter}
+}
+
 func (wt WhereTerm) ToSQL() string {
 	var s string
 	switch wt.Op {
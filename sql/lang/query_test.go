@@ -0,0 +1,465 @@
+package query
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStatements(t *testing.T) {
+	for _, test := range []struct {
+		querystring string
+		statements  int
+		contains    []string // substrings of the generated SQL of each statement
+	}{
+		{
+			`select * where Location/Room = "4;10";`,
+			1,
+			[]string{`data.dval = "4;10"`},
+		},
+		{
+			"select *\nwhere Location/Room = '410'\nand has Metadata/Exposure;",
+			1,
+			[]string{`data.dkey = "Metadata/Exposure"`},
+		},
+		{
+			"select * where Location/Room = 'a;b'; select distinct uuid where has Location/Room;\n",
+			2,
+			[]string{`data.dval = 'a;b'`, `data.dkey = "Location/Room"`},
+		},
+	} {
+		lex := NewQueryLexer(test.querystring)
+		QueryParse(lex)
+		if lex.Err != nil {
+			t.Errorf("Query %v: unexpected error %v", test.querystring, lex.Err)
+			continue
+		}
+		if len(lex.Queries) != test.statements {
+			t.Errorf("Query %v: got %d statements but wanted %d", test.querystring, len(lex.Queries), test.statements)
+			continue
+		}
+		for idx, q := range lex.Queries {
+			if !strings.Contains(q.Wheres.SQL, test.contains[idx]) {
+				t.Errorf("Query %v: statement %d does not contain %v:\n%v", test.querystring, idx, test.contains[idx], q.Wheres.SQL)
+			}
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	for _, test := range []struct {
+		querystring string
+		explain     bool
+		tree        string
+	}{
+		{
+			`select * where Location/Room = '410';`,
+			false,
+			"Location/Room = '410' (most recent value)\n",
+		},
+		{
+			`explain select Location/Room where has Location/Room and not (Metadata/Exposure ~ 'S%' or Location/Room != '405' at 8);`,
+			true,
+			"and\n" +
+				"  has Location/Room (most recent value)\n" +
+				"  not\n" +
+				"    or\n" +
+				"      Metadata/Exposure like 'S%' (most recent value)\n" +
+				"      Location/Room != '405' (value at " + time.Unix(8, 0).Format(time.RFC3339) + ")\n",
+		},
+	} {
+		lex := NewQueryLexer(test.querystring)
+		QueryParse(lex)
+		if lex.Err != nil {
+			t.Errorf("Query %v: unexpected error %v", test.querystring, lex.Err)
+			continue
+		}
+		if len(lex.Queries) != 1 {
+			t.Errorf("Query %v: got %d statements but wanted 1", test.querystring, len(lex.Queries))
+			continue
+		}
+		q := lex.Queries[0]
+		if q.Explain != test.explain {
+			t.Errorf("Query %v: got explain %v but wanted %v", test.querystring, q.Explain, test.explain)
+		}
+		if tree := q.Wheres.Node.String(); tree != test.tree {
+			t.Errorf("Query %v: got where clause\n%v\nbut wanted\n%v", test.querystring, tree, test.tree)
+		}
+	}
+}
+
+// Words of the query language that are not keywords can still be used as keys
+func TestKeysNamedLikeKeywords(t *testing.T) {
+	for _, querystring := range []string{
+		`select * where has diff;`,
+		`select diff where diff = "a";`,
+		`select diff at now where has diff;`,
+		`select from where from = "a" and changed(from) from "a";`,
+		`select duration, least where has least and duration = "2h" for at least 1h in (0, 10);`,
+		`define event event at 100; select define at event where has event;`,
+		`select timezone where timezone = "UTC";`,
+	} {
+		lex := NewQueryLexer(querystring)
+		QueryParse(lex)
+		if lex.Err != nil {
+			t.Errorf("Query %v: unexpected error %v", querystring, lex.Err)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	lex := NewQueryLexer(`select diff(now -7d, now) where has Location/Building;`)
+	QueryParse(lex)
+	if lex.Err != nil {
+		t.Fatalf("Unexpected error %v", lex.Err)
+	}
+	q := lex.Queries[0]
+	term, found := q.Diff()
+	if !found {
+		t.Fatalf("Expected a diff term in %v", q.Selects)
+	}
+	if !term.EndTime.Equal(lex.Now) || !term.StartTime.Equal(lex.Now.Add(-7*24*time.Hour)) {
+		t.Errorf("Got diff from %v to %v but wanted from %v to %v", term.StartTime, term.EndTime, lex.Now.Add(-7*24*time.Hour), lex.Now)
+	}
+	if _, found = (&Query{Selects: []SelectTerm{{Tag: "Location/Room"}}}).Diff(); found {
+		t.Errorf("Expected no diff term")
+	}
+
+	lex = NewQueryLexer(`define event sag1 in (100, 200); select diff(sag1, sag1.end +1s) where has Location/Building;`)
+	QueryParse(lex)
+	if lex.Err != nil {
+		t.Fatalf("Unexpected error %v", lex.Err)
+	}
+	if term, _ = lex.Queries[1].Diff(); !term.StartTime.Equal(time.Unix(100, 0)) || !term.EndTime.Equal(time.Unix(201, 0)) {
+		t.Errorf("Got diff from %v to %v but wanted from the start of sag1 to a second after its end", term.StartTime, term.EndTime)
+	}
+
+	for _, querystring := range []string{
+		`select diff(now) where has Location/Building;`,
+		`select diff(sag2, now) where has Location/Building;`,
+	} {
+		lex = NewQueryLexer(querystring)
+		QueryParse(lex)
+		if lex.Err == nil {
+			t.Errorf("Query %v: expected an error", querystring)
+		}
+	}
+}
+
+func TestDurations(t *testing.T) {
+	lex := NewQueryLexer(`select duration(Status/Fault) in (100, 200) where Status/Fault = "overheat" for at least 2h in (100, 200);`)
+	QueryParse(lex)
+	if lex.Err != nil {
+		t.Fatalf("Unexpected error %v", lex.Err)
+	}
+	q := lex.Queries[0]
+	tree := "Status/Fault = \"overheat\" (true for at least 2h0m0s in [" + time.Unix(100, 0).Format(time.RFC3339) + ", " + time.Unix(200, 0).Format(time.RFC3339) + "))\n"
+	if got := q.Wheres.Node.String(); got != tree {
+		t.Errorf("Got where clause\n%v\nbut wanted\n%v", got, tree)
+	}
+	for _, s := range []string{`having sum(timestampdiff(microsecond, intervals.began, intervals.ended)) >= 7200000000`, `"1970-01-01 00:01:40.000000"`} {
+		if !strings.Contains(q.Wheres.SQL, s) {
+			t.Errorf("Expected generated SQL to contain %v but got\n%v", s, q.Wheres.SQL)
+		}
+	}
+	if len(q.Selects) != 1 || q.Selects[0].Filter != DURATION || q.Selects[0].Tag != "Status/Fault" {
+		t.Fatalf("Expected a duration term but got %v", q.Selects)
+	}
+	if sql := q.Selects[0].DurationSQL("data.uuid = ?"); !strings.Contains(sql, `"1970-01-01 00:03:20.000000"`) || !strings.Contains(sql, `data.dkey = "Status/Fault" and data.uuid = ?`) {
+		t.Errorf("Unexpected duration SQL\n%v", sql)
+	}
+
+	for _, querystring := range []string{
+		`select duration(Status/Fault) where has Status/Fault;`,
+		`select duration(Status/Fault, Status/Alarm) in (100, 200) where has Status/Fault;`,
+		`select * where has Status/Fault for at most 2h in (100, 200);`,
+	} {
+		lex = NewQueryLexer(querystring)
+		QueryParse(lex)
+		if lex.Err == nil {
+			t.Errorf("Query %v: expected an error", querystring)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	for _, test := range []struct {
+		querystring string
+		tree        string
+		contains    []string
+	}{
+		{
+			`select * where Equipment/AHU -> Location/Building = "Soda";`,
+			"Equipment/AHU -> Location/Building = \"Soda\" (most recent value)\n",
+			[]string{`from current as link`, `on data.uuid = link.dval`, `link.dkey = "Equipment/AHU"`, `data.dkey = "Location/Building" and data.dval = "Soda"`},
+		},
+		{
+			`select * where Equipment/AHU -> has Location/Building at 10 and has Point/Type;`,
+			"and\n" +
+				"  has Equipment/AHU -> Location/Building (value at " + time.Unix(10, 0).Format(time.RFC3339) + ")\n" +
+				"  has Point/Type (most recent value)\n",
+			[]string{`where dkey = "Equipment/AHU" and timestamp <= "1970-01-01 00:00:10.000000"`, `where timestamp <= "1970-01-01 00:00:10.000000"`},
+		},
+	} {
+		lex := NewQueryLexer(test.querystring)
+		QueryParse(lex)
+		if lex.Err != nil {
+			t.Errorf("Query %v: unexpected error %v", test.querystring, lex.Err)
+			continue
+		}
+		q := lex.Queries[0]
+		if tree := q.Wheres.Node.String(); tree != test.tree {
+			t.Errorf("Query %v: got where clause\n%v\nbut wanted\n%v", test.querystring, tree, test.tree)
+		}
+		for _, s := range test.contains {
+			if !strings.Contains(q.Wheres.SQL, s) {
+				t.Errorf("Query %v: expected generated SQL to contain %v but got\n%v", test.querystring, s, q.Wheres.SQL)
+			}
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	lex := NewQueryLexer(`define event sag1 in (100, 200); select Location/Room at sag1.end where Location/Room = "410" at sag1.start;`)
+	lex.Events = map[string]Event{"other": {Name: "other", Start: time.Unix(1, 0), End: time.Unix(2, 0)}}
+	QueryParse(lex)
+	if lex.Err != nil {
+		t.Fatalf("Unexpected error %v", lex.Err)
+	}
+	if len(lex.Queries) != 2 {
+		t.Fatalf("Expected 2 statements but got %d", len(lex.Queries))
+	}
+	expected := Event{Name: "sag1", Start: time.Unix(100, 0), End: time.Unix(200, 0)}
+	if define := lex.Queries[0].Define; define == nil || *define != expected {
+		t.Errorf("Got definition %v but wanted %v", define, expected)
+	}
+	q := lex.Queries[1]
+	if q.Selects[0].Filter != AT || !q.Selects[0].StartTime.Equal(expected.End) {
+		t.Errorf("Expected the select term at the end of the event but got %v", q.Selects[0])
+	}
+	if tree := "Location/Room = \"410\" (value at " + expected.Start.Format(time.RFC3339) + ")\n"; q.Wheres.Node.String() != tree {
+		t.Errorf("Got where clause\n%v\nbut wanted\n%v", q.Wheres.Node.String(), tree)
+	}
+
+	// names that start with a keyword are not split into the keyword and the
+	// rest of the name
+	lex = NewQueryLexer(`define event inspection in (100, 200); define event settled at 300; select * where has Location/Room at inspection.end;`)
+	QueryParse(lex)
+	if lex.Err != nil {
+		t.Fatalf("Unexpected error %v", lex.Err)
+	}
+	if len(lex.Queries) != 3 || lex.Queries[0].Define.Name != "inspection" || lex.Queries[1].Define.Name != "settled" {
+		t.Errorf("Expected events inspection and settled but got %v", lex.Queries)
+	}
+
+	for querystring, message := range map[string]string{
+		`select * where has Location/Room at sag2.start;`:   `unknown event "sag2"`,
+		`select * where has Location/Room at other.middle;`: `unknown event time "other.middle", expecting other.start or other.end`,
+		`define event backwards in (200, 100);`:             `event backwards ends before it starts`,
+		`define evnt sag2 at 100;`:                          `unexpected evnt, expecting event`,
+	} {
+		lex := NewQueryLexer(querystring)
+		lex.Events = map[string]Event{"other": {Name: "other"}}
+		QueryParse(lex)
+		if lex.Err == nil || lex.Err.(*QueryError).Message != message {
+			t.Errorf("Query %v: got error %v but wanted %v", querystring, lex.Err, message)
+		}
+	}
+}
+
+func TestTimezones(t *testing.T) {
+	for _, test := range []struct {
+		querystring string
+		expected    string
+	}{
+		// without a time zone, literals are UTC
+		{`select A at "2015-01-02 10:00:00";`, "2015-01-02T10:00:00Z"},
+		{`set timezone 'America/Los_Angeles'; select A at "2015-01-02 10:00:00";`, "2015-01-02T18:00:00Z"},
+		{`set timezone 'America/Los_Angeles'; select A at "1/2/2015";`, "2015-01-02T08:00:00Z"},
+		// zone abbreviations other than those of the time zone of the query
+		// are read at their own offset
+		{`select A at "1/2/2015 10:00:00 PM PST";`, "2015-01-03T06:00:00Z"},
+		{`set timezone 'America/New_York'; select A at "1/2/2015 22:00:00 PDT";`, "2015-01-03T05:00:00Z"},
+		{`set timezone 'America/Los_Angeles'; select A at "1/2/2015 22:00:00 PST";`, "2015-01-03T06:00:00Z"},
+		{`set timezone 'America/Los_Angeles'; select A at "1/2/2015 22:00:00 GMT";`, "2015-01-02T22:00:00Z"},
+		// RFC3339 literals carry their own offset
+		{`set timezone 'America/Los_Angeles'; select A at "2015-01-02T10:00:00+01:00";`, "2015-01-02T09:00:00Z"},
+		{`select A at "2015-01-01" +2w;`, "2015-01-15T00:00:00Z"},
+		// months are added on the calendar of the time zone
+		{`set timezone 'America/Los_Angeles'; select A at "2015-03-01" -1mo;`, "2015-02-01T08:00:00Z"},
+		{`select A at startof(week, "2015-01-01T12:00:00Z");`, "2014-12-29T00:00:00Z"},
+		{`select A at startof(month, "2015-01-20T12:00:00Z") +1d;`, "2015-01-02T00:00:00Z"},
+		// daylight saving time started on March 8th
+		{`set timezone 'America/Los_Angeles'; select A at startof(day, "2015-03-10T05:00:00Z");`, "2015-03-09T07:00:00Z"},
+	} {
+		lex := NewQueryLexer(test.querystring)
+		QueryParse(lex)
+		if lex.Err != nil {
+			t.Errorf("Query %v: unexpected error %v", test.querystring, lex.Err)
+			continue
+		}
+		q := lex.Queries[len(lex.Queries)-1]
+		if got := q.Selects[0].StartTime.Format(time.RFC3339); got != test.expected {
+			t.Errorf("Query %v: got %v but wanted %v", test.querystring, got, test.expected)
+		}
+	}
+
+	for querystring, message := range map[string]string{
+		`set tz 'UTC';`:                                     `unexpected tz, expecting timezone`,
+		`set timezone 'Mars/Olympus_Mons';`:                 `unknown time zone "Mars/Olympus_Mons"`,
+		`select A at "1/2/2015 22:00:00 XYZ";`:              `Unknown time zone abbreviation XYZ in "1/2/2015 22:00:00 XYZ" (use a numeric offset, or set timezone to a zone that uses it)`,
+		`select A at startof(decade, now);`:                 `Invalid unit decade. Must be second,minute,hour,day,week,month,year`,
+		`select A at endof(day, now);`:                      `unknown function endof(), expecting startof()`,
+		`select * where has A for at least 1mo in (0, 10);`: `months are not a fixed duration`,
+	} {
+		lex := NewQueryLexer(querystring)
+		QueryParse(lex)
+		if lex.Err == nil || lex.Err.(*QueryError).Message != message {
+			t.Errorf("Query %v: got error %v but wanted %v", querystring, lex.Err, message)
+		}
+	}
+}
+
+func TestSubSecond(t *testing.T) {
+	micro := time.Unix(1447366661, 123456000).UTC()
+	nano := time.Unix(1447366661, 123456789).UTC()
+	for _, test := range []struct {
+		querystring string
+		expected    time.Time
+	}{
+		{`select * where has A at 1447366661123 ms;`, time.Unix(1447366661, 123000000).UTC()},
+		{`select * where has A at 1447366661123456 us;`, micro},
+		{`select * where has A at 1447366661123456789 ns;`, nano},
+		{`select * where has A at 1447366661.123456;`, micro},
+		{`select * where has A at 1447366661.123456789;`, nano},
+		{`select * where has A at "2015-11-12T22:17:41.123456789Z";`, nano},
+		{`select * where has A at "2015-11-12 22:17:41.123456";`, micro},
+		{`select * where has A at 1447366661 +500us;`, time.Unix(1447366661, 500000).UTC()},
+	} {
+		lex := NewQueryLexer(test.querystring)
+		QueryParse(lex)
+		if lex.Err != nil {
+			t.Errorf("Query %v: unexpected error %v", test.querystring, lex.Err)
+			continue
+		}
+		q := lex.Queries[0]
+		// MySQL stores microseconds, so literals are truncated to them;
+		// descriptions keep every digit
+		if literal := `"` + test.expected.Format("2006-01-02 15:04:05.000000") + `"`; !strings.Contains(q.Wheres.SQL, literal) {
+			t.Errorf("Query %v: expected %v in\n%v", test.querystring, literal, q.Wheres.SQL)
+		}
+		if tree := "has A (value at " + test.expected.Format(time.RFC3339Nano) + ")\n"; q.Wheres.Node.String() != tree {
+			t.Errorf("Query %v: got where clause\n%v\nbut wanted\n%v", test.querystring, q.Wheres.Node.String(), tree)
+		}
+	}
+
+	lex := NewQueryLexer(`select * where has A at 1447366661.1234567891;`)
+	QueryParse(lex)
+	if lex.Err == nil {
+		t.Errorf("Expected an error for more than nanosecond precision")
+	}
+
+	for s, expected := range map[string]time.Time{
+		"1447366661.123456789":           nano,
+		"1447366661.5":                   time.Unix(1447366661, 500000000).UTC(),
+		"2015-11-12T22:17:41.123456789Z": nano,
+		// zone abbreviations are read at their own offset, as in queries
+		"1/2/2015 10:00:00 PM PST": time.Date(2015, 1, 3, 6, 0, 0, 0, time.UTC),
+		"1/2/2015 22:00:00 CET":    time.Date(2015, 1, 2, 21, 0, 0, 0, time.UTC),
+	} {
+		if got, err := ParseTime(s); err != nil || !got.Equal(expected) {
+			t.Errorf("ParseTime(%v) = %v, %v but wanted %v", s, got, err, expected)
+		}
+	}
+	if got, err := ParseTime("1/2/2015 22:00:00 XYZ"); err == nil {
+		t.Errorf("Expected an error for an unknown zone abbreviation but got %v", got)
+	}
+}
+
+func TestChanged(t *testing.T) {
+	for _, test := range []struct {
+		querystring string
+		tree        string
+		contains    []string
+	}{
+		{
+			`select * where changed(Sensor/Model);`,
+			"changed(Sensor/Model) (any change)\n",
+			[]string{`cur.dkey = "Sensor/Model"`, `oldval is not null and oldval != newval`},
+		},
+		{
+			`select * where changed(Sensor/Model) from 'SHT11' to 'SHT13' in (10, 20) and has Location/Room;`,
+			"and\n" +
+				"  changed(Sensor/Model) from 'SHT11' to 'SHT13' (changed in [" + time.Unix(10, 0).Format(time.RFC3339) + ", " + time.Unix(20, 0).Format(time.RFC3339) + "))\n" +
+				"  has Location/Room (most recent value)\n",
+			[]string{`oldval = 'SHT11' and newval = 'SHT13'`, `cur.timestamp >= "1970-01-01 00:00:10.000000"`},
+		},
+		{
+			`select * where changed(Sensor/Model) to "SHT13";`,
+			"changed(Sensor/Model) to \"SHT13\" (any change)\n",
+			[]string{`and newval = "SHT13"`},
+		},
+	} {
+		lex := NewQueryLexer(test.querystring)
+		QueryParse(lex)
+		if lex.Err != nil {
+			t.Errorf("Query %v: unexpected error %v", test.querystring, lex.Err)
+			continue
+		}
+		q := lex.Queries[0]
+		if tree := q.Wheres.Node.String(); tree != test.tree {
+			t.Errorf("Query %v: got where clause\n%v\nbut wanted\n%v", test.querystring, tree, test.tree)
+		}
+		if len(q.Transitions) != 1 {
+			t.Errorf("Query %v: got %d changed terms but wanted 1", test.querystring, len(q.Transitions))
+		}
+		for _, s := range test.contains {
+			if !strings.Contains(q.Wheres.SQL, s) {
+				t.Errorf("Query %v: expected generated SQL to contain %v but got\n%v", test.querystring, s, q.Wheres.SQL)
+			}
+		}
+	}
+}
+
+func TestTraversal(t *testing.T) {
+	for _, test := range []struct {
+		querystring string
+		expected    string
+	}{
+		{`select traverse(Equipment/AHU) where uuid = "c1";`, "traverse(Equipment/AHU) downstream"},
+		{`select traverse(Equipment/AHU, Equipment/VAV) upstream where has Equipment/AHU;`, "traverse(Equipment/AHU, Equipment/VAV) upstream"},
+		{`select traverse(Equipment/AHU) depth 2 at 1000 where uuid = "c1";`, "traverse(Equipment/AHU) downstream depth 2 at " + time.Unix(1000, 0).Format(time.RFC3339Nano)},
+		{`select traverse(Equipment/AHU) downstream depth 3 where uuid = "c1";`, "traverse(Equipment/AHU) downstream depth 3"},
+	} {
+		lex := NewQueryLexer(test.querystring)
+		QueryParse(lex)
+		if lex.Err != nil {
+			t.Errorf("Query %v: unexpected error %v", test.querystring, lex.Err)
+			continue
+		}
+		q := lex.Queries[0]
+		if q.Traversal == nil || q.Selects != nil || q.Wheres.SQL == "" {
+			t.Errorf("Query %v: expected a traversal from the matching documents but got %+v", test.querystring, q)
+			continue
+		}
+		if s := q.Traversal.String(); s != test.expected {
+			t.Errorf("Query %v: got traversal %v but wanted %v", test.querystring, s, test.expected)
+		}
+	}
+
+	for _, querystring := range []string{
+		`select walk(Equipment/AHU) where uuid = "c1";`,
+		`select traverse(Equipment/AHU) sideways where uuid = "c1";`,
+		`select traverse(Equipment/AHU) depth 0 where uuid = "c1";`,
+		`select traverse(Equipment/AHU) height 2 where uuid = "c1";`,
+		`select traverse(Equipment/AHU);`,
+		`select traverse(Equipment/AHU), Location/Room where uuid = "c1";`,
+		`select traverse(1000) where uuid = "c1";`,
+	} {
+		lex := NewQueryLexer(querystring)
+		QueryParse(lex)
+		if lex.Err == nil {
+			t.Errorf("Query %v: expected an error", querystring)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -50,12 +51,155 @@ func parseReltime(num, units string) (time.Duration, error) {
 		d *= time.Nanosecond
 	case "d", "day", "days":
 		d *= 24 * time.Hour
+	case "w", "wk", "week", "weeks":
+		d *= 7 * 24 * time.Hour
 	default:
-		err = fmt.Errorf("Invalid unit %v. Must be h,m,s,us,ms,ns,d", units)
+		err = fmt.Errorf("Invalid unit %v. Must be h,m,s,us,ms,ns,d,w", units)
 	}
 	return d, err
 }
 
+// A relative time in a query. Months have no fixed length, so they are kept
+// apart from the rest of the duration and added on the calendar
+type relTime struct {
+	months   int
+	duration time.Duration
+}
+
+// Like parseReltime, but also accepts months ("mo", "month", "months")
+func parseRelTime(num, units string) (relTime, error) {
+	switch units {
+	case "mo", "month", "months":
+		i, err := strconv.ParseInt(num, 10, 64)
+		return relTime{months: int(i)}, err
+	}
+	d, err := parseReltime(num, units)
+	return relTime{duration: d}, err
+}
+
+func (rt relTime) add(other relTime) relTime {
+	return relTime{months: rt.months + other.months, duration: addDurations(rt.duration, other.duration)}
+}
+
+// Adds the relative time to t. Months are added in the given time zone, so
+// that "-1mo" from midnight on the 1st is midnight on the 1st of the previous
+// month there. The result is in UTC
+func (rt relTime) addTo(t time.Time, loc *time.Location) time.Time {
+	if rt.months != 0 {
+		t = t.In(loc).AddDate(0, rt.months, 0)
+	}
+	return t.Add(rt.duration).UTC()
+}
+
+// Returns the relative time as a fixed duration, which it is not if it has
+// months
+func (rt relTime) fixed() (time.Duration, error) {
+	if rt.months != 0 {
+		return rt.duration, errors.New("months are not a fixed duration")
+	}
+	return rt.duration, nil
+}
+
+// layouts of time literals without a time zone, which are read in the time
+// zone of the query. RFC3339 literals carry their own offset
+var localFormats = []string{
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// Parses a quoted time literal in a query. Literals without a time zone are
+// read in loc. The result is in UTC
+func parseTimeLiteral(literal string, loc *time.Location) (time.Time, error) {
+	s := strings.Trim(literal, "\"'")
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UTC(), nil
+	}
+	for _, format := range localFormats {
+		if t, err := time.ParseInLocation(format, s, loc); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	for _, format := range supported_formats {
+		if t, err := time.ParseInLocation(format, s, loc); err == nil {
+			return resolveZone(t, loc, literal)
+		}
+	}
+	return time.Time{}, fmt.Errorf("No time format matching %v found", literal)
+}
+
+// the UTC offsets, in seconds, of the time zone abbreviations time literals
+// may end with, besides those of the time zone of the query. Abbreviations
+// that stand for several zones, such as IST or BST, are left out
+var zoneOffsets = map[string]int{
+	"UTC":  0,
+	"GMT":  0,
+	"EST":  -5 * 3600,
+	"EDT":  -4 * 3600,
+	"CST":  -6 * 3600,
+	"CDT":  -5 * 3600,
+	"MST":  -7 * 3600,
+	"MDT":  -6 * 3600,
+	"PST":  -8 * 3600,
+	"PDT":  -7 * 3600,
+	"AKST": -9 * 3600,
+	"AKDT": -8 * 3600,
+	"HST":  -10 * 3600,
+	"WET":  0,
+	"WEST": 1 * 3600,
+	"CET":  1 * 3600,
+	"CEST": 2 * 3600,
+	"EET":  2 * 3600,
+	"EEST": 3 * 3600,
+	"JST":  9 * 3600,
+	"AEST": 10 * 3600,
+	"AEDT": 11 * 3600,
+}
+
+// Returns the parsed time in UTC. time.ParseInLocation only knows the
+// abbreviations of loc, and reads any other abbreviation as offset 0, so
+// the time is moved to the offset of the abbreviation if it is in
+// zoneOffsets, and rejected if it is unknown
+func resolveZone(t time.Time, loc *time.Location, literal string) (time.Time, error) {
+	if t.Location() == loc {
+		return t.UTC(), nil
+	}
+	name, offset := t.Zone()
+	if known, found := zoneOffsets[name]; found {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.FixedZone(name, known))
+	} else if offset == 0 {
+		return time.Time{}, fmt.Errorf("Unknown time zone abbreviation %s in %v (use a numeric offset, or set timezone to a zone that uses it)", name, literal)
+	}
+	return t.UTC(), nil
+}
+
+// Returns the start of the calendar unit ("second", "minute", "hour", "day",
+// "week", "month" or "year") that t is in, in the given time zone. Weeks
+// start on Monday. The result is in UTC
+func startOf(unit string, t time.Time, loc *time.Location) (time.Time, error) {
+	t = t.In(loc)
+	year, month, day := t.Date()
+	switch unit {
+	case "second":
+		t = time.Date(year, month, day, t.Hour(), t.Minute(), t.Second(), 0, loc)
+	case "minute":
+		t = time.Date(year, month, day, t.Hour(), t.Minute(), 0, 0, loc)
+	case "hour":
+		t = time.Date(year, month, day, t.Hour(), 0, 0, 0, loc)
+	case "day":
+		t = time.Date(year, month, day, 0, 0, 0, 0, loc)
+	case "week":
+		t = time.Date(year, month, day-(int(t.Weekday())+6)%7, 0, 0, 0, 0, loc)
+	case "month":
+		t = time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	case "year":
+		t = time.Date(year, time.January, 1, 0, 0, 0, 0, loc)
+	default:
+		return t, fmt.Errorf("Invalid unit %v. Must be second,minute,hour,day,week,month,year", unit)
+	}
+	return t.UTC(), nil
+}
+
 func parseAbsTime(num, units string) (time.Time, error) {
 	var d time.Time
 	var err error
@@ -74,6 +218,33 @@ func parseAbsTime(num, units string) (time.Time, error) {
 	return d, err
 }
 
+// Parses UNIX seconds with an optional fraction of up to nanosecond
+// precision, e.g. "1447366661.123456789". The fraction is read digit by digit
+// rather than as a float so that it is exact
+func parseUnixTime(num string) (time.Time, error) {
+	secs, frac := num, ""
+	if idx := strings.IndexByte(num, '.'); idx >= 0 {
+		secs, frac = num[:idx], num[idx+1:]
+	}
+	if len(frac) > 9 {
+		return time.Time{}, fmt.Errorf("%v has more than nanosecond precision", num)
+	}
+	i, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var ns int64
+	if len(frac) > 0 {
+		if ns, err = strconv.ParseInt((frac + "00000000")[:9], 10, 64); err != nil {
+			return time.Time{}, err
+		}
+	}
+	if strings.HasPrefix(secs, "-") {
+		ns = -ns
+	}
+	return time.Unix(i, ns), nil
+}
+
 /**
 Takes 2 durations and returns the result of them added together
 */
@@ -160,3 +331,22 @@ func convertTime(time uint64, stream_uot, target_uot UnitOfTime) uint64 {
 		return time / uint64(unitmultiplier[stream_uot]/unitmultiplier[target_uot])
 	}
 }
+
+// Parses a time given outside of a query string (e.g. as an HTTP parameter).
+// Accepts UNIX seconds with an optional fraction and the time literals of
+// queries, read in UTC unless they carry a zone (see parseTimeLiteral)
+func ParseTime(s string) (time.Time, error) {
+	if t, err := parseUnixTime(s); err == nil {
+		return t, nil
+	}
+	return parseTimeLiteral(s, time.UTC)
+}
+
+// Parses a duration given outside of a query string. Accepts Go durations
+// such as "36h" or "1h30m", and whole days such as "90d"
+func ParseDuration(s string) (time.Duration, error) {
+	if len(s) > 1 && s[len(s)-1] == 'd' {
+		return parseReltime(s[:len(s)-1], "d")
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// A migration upgrades the schema by one version. Migrations are applied in
+// order and must not be changed once released: to change the schema, append
+// a new one
+type migration struct {
+	version     int
+	description string
+	apply       func(ctx context.Context, db *sql.Conn) error
+}
+
+var migrations = []migration{
+	{1, "create data table", execAll(`
+CREATE TABLE IF NOT EXISTS data
+(
+    uuid CHAR(37) NOT NULL,
+    dkey VARCHAR(128) NOT NULL,
+    dval VARCHAR(128) NULL,
+    timestamp TIMESTAMP(6) NOT NULL
+);
+`)},
+	{2, "index data by document and by value", func(ctx context.Context, db *sql.Conn) error {
+		// the uuid index serves the max(timestamp) group by uuid, dkey scans;
+		// the value index serves the WHERE terms
+		if err := createIndex(ctx, db, "data", "data_uuid_dkey_timestamp", "uuid, dkey, timestamp"); err != nil {
+			return err
+		}
+		return createIndex(ctx, db, "data", "data_dkey_dval_timestamp", "dkey, dval, timestamp")
+	}},
+	{3, "add current state table", func(ctx context.Context, db *sql.Conn) error {
+		if _, err := db.ExecContext(ctx, currentCreate); err != nil {
+			return err
+		}
+		return rebuildCurrent(ctx, db)
+	}},
+	{4, "add checkpoints table", execAll(checkpointsCreate)},
+	{5, "add events table", execAll(eventsCreate)},
+	{6, "add transaction clock and document versions", execAll(txnClockCreate, txnClockInit, documentVersionsCreate)},
+	{7, "add pending transaction timestamps", execAll(txnPendingCreate)},
+}
+
+var schemaVersionCreate = `
+CREATE TABLE IF NOT EXISTS schema_version
+(
+    version INT NOT NULL PRIMARY KEY,
+    description VARCHAR(128) NOT NULL,
+    applied TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+);
+`
+
+// name of the advisory lock held while migrating, so that servers started
+// together do not apply the same migration twice
+const migrationLock = "aronnax_schema_migration"
+
+// Brings the schema up to the latest version, returning that version.
+// Databases created before schema versions were recorded have a data table
+// but no schema_version table; they start at version 0 and are upgraded in
+// place
+func migrate(ctx context.Context, pool *sql.DB) (int, error) {
+	// the advisory lock belongs to a connection, so all statements run on
+	// the same one
+	db, err := pool.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var locked sql.NullInt64
+	if err = db.QueryRowContext(ctx, "SELECT GET_LOCK(?, 60);", migrationLock).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked.Valid || locked.Int64 != 1 {
+		return 0, fmt.Errorf("Could not acquire schema migration lock %s", migrationLock)
+	}
+	defer db.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?);", migrationLock)
+
+	if _, err = db.ExecContext(ctx, schemaVersionCreate); err != nil {
+		return 0, err
+	}
+	version, err := schemaVersion(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		// MySQL commits DDL statements implicitly, so a migration cannot be
+		// rolled back. Each step is written to be safe to run again instead
+		if err = m.apply(ctx, db); err != nil {
+			return version, fmt.Errorf("Could not apply schema migration %d (%s): %v", m.version, m.description, err)
+		}
+		if _, err = db.ExecContext(ctx, "INSERT INTO schema_version (version, description) VALUES (?, ?);", m.version, m.description); err != nil {
+			return version, err
+		}
+		log.Printf("Migrated schema to version %d (%s)", m.version, m.description)
+		version = m.version
+	}
+	return version, nil
+}
+
+// Returns the latest schema version recorded in the database
+func schemaVersion(ctx context.Context, db queryer) (int, error) {
+	var version int
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version;").Scan(&version)
+	return version, err
+}
+
+// Returns a migration step that executes the statements in order
+func execAll(statements ...string) func(ctx context.Context, db *sql.Conn) error {
+	return func(ctx context.Context, db *sql.Conn) error {
+		for _, stmt := range statements {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Creates the index unless the table already has an index with that name
+func createIndex(ctx context.Context, db *sql.Conn, table, name, columns string) error {
+	var count int
+	err := db.QueryRowContext(ctx, `
+SELECT COUNT(*) FROM information_schema.statistics
+WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?;`, table, name).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf("CREATE INDEX %s ON %s (%s);", name, table, columns))
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	latest := migrations[len(migrations)-1].version
+
+	// newBackend has already migrated, so this must not apply anything
+	version, err := migrate(context.Background(), backend.db)
+	if err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if version != latest {
+		t.Errorf("Expected schema version %d but got %d", latest, version)
+	}
+	var applied int
+	if err = backend.db.QueryRow("SELECT COUNT(*) FROM schema_version;").Scan(&applied); err != nil {
+		t.Fatalf("Could not read schema versions: %v", err)
+	}
+	if applied != len(migrations) {
+		t.Errorf("Expected %d recorded migrations but got %d", len(migrations), applied)
+	}
+
+	for _, index := range []string{"data_uuid_dkey_timestamp", "data_dkey_dval_timestamp"} {
+		var count int
+		err = backend.db.QueryRow(`SELECT COUNT(*) FROM information_schema.statistics
+		WHERE table_schema = DATABASE() AND table_name = 'data' AND index_name = ?;`, index).Scan(&count)
+		if err != nil {
+			t.Fatalf("Could not read indexes: %v", err)
+		}
+		if count == 0 {
+			t.Errorf("Expected index %s on data", index)
+		}
+	}
+}
+
+// MySQL cannot roll back a migration, so a server that fails before recording
+// one applies it again: applying every migration twice must change nothing
+func TestMigrationsRepeatable(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	ctx := context.Background()
+	db, err := backend.db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Could not open a connection: %v", err)
+	}
+	defer db.Close()
+
+	before, err := describeSchema(ctx, db)
+	if err != nil {
+		t.Fatalf("Could not describe the schema: %v", err)
+	}
+	for _, m := range migrations {
+		if err = m.apply(ctx, db); err != nil {
+			t.Fatalf("Could not apply schema migration %d (%s) again: %v", m.version, m.description, err)
+		}
+	}
+	after, err := describeSchema(ctx, db)
+	if err != nil {
+		t.Fatalf("Could not describe the schema: %v", err)
+	}
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("Applying the migrations again changed the schema from\n%v\nto\n%v", before, after)
+	}
+}
+
+// Returns the columns and indexes of the tables in the database, and the
+// number of rows in the tables that migrations fill in
+func describeSchema(ctx context.Context, db *sql.Conn) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+SELECT CONCAT_WS(' ', table_name, column_name, column_type, is_nullable) FROM information_schema.columns
+WHERE table_schema = DATABASE()
+UNION ALL
+SELECT CONCAT_WS(' ', table_name, index_name, seq_in_index, column_name) FROM information_schema.statistics
+WHERE table_schema = DATABASE()
+ORDER BY 1;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var description []string
+	for rows.Next() {
+		var line string
+		if err = rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		description = append(description, line)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, table := range []string{"schema_version", "current", "txn_clock"} {
+		var count int
+		if err = db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s;", table)).Scan(&count); err != nil {
+			return nil, err
+		}
+		description = append(description, fmt.Sprintf("%s: %d rows", table, count))
+	}
+	return description, nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/satori/go.uuid"
+	"strings"
+	"time"
+)
+
+// Each batch takes a transaction timestamp from the txn_clock table when it
+// commits. The clock is shared by every server writing to the database and
+// hands out strictly increasing timestamps; the row is only locked while a
+// timestamp is taken. The edits of a batch without an explicit valid time are
+// stored at its transaction timestamp.
+//
+// Batches then run concurrently and are validated when they commit: each
+// records the version of the documents it edits in document_versions, and
+// fails if another batch committed edits to one of them after it started
+// (first committer wins). A batch that fails validation is retried with a
+// new timestamp, so batches that edit the same document commit in timestamp
+// order, while batches on different documents do not wait for each other.
+//
+// Batches on different documents may therefore commit out of timestamp order.
+// Each timestamp is recorded in txn_pending when it is taken and removed by
+// the transaction of its batch, or once the batch fails, so that a snapshot
+// can tell which timestamps may still commit (see Snapshot)
+var txnClockCreate = `
+CREATE TABLE IF NOT EXISTS txn_clock
+(
+    id TINYINT NOT NULL PRIMARY KEY,
+    last BIGINT NOT NULL
+);
+`
+
+var txnClockInit = `INSERT IGNORE INTO txn_clock (id, last) VALUES (1, 0);`
+
+var documentVersionsCreate = `
+CREATE TABLE IF NOT EXISTS document_versions
+(
+    uuid CHAR(37) NOT NULL PRIMARY KEY,
+    version BIGINT NOT NULL
+);
+`
+
+// advances the clock to the current time, or one microsecond after the last
+// timestamp if that is not after it, and returns the new timestamp in
+// microseconds through LAST_INSERT_ID
+var clockTick = `
+UPDATE txn_clock
+SET last = LAST_INSERT_ID(GREATEST(last + 1, CAST(UNIX_TIMESTAMP(NOW(6)) * 1000000 AS SIGNED)))
+WHERE id = 1;
+`
+
+var txnPendingCreate = `
+CREATE TABLE IF NOT EXISTS txn_pending
+(
+    timestamp BIGINT NOT NULL PRIMARY KEY
+);
+`
+
+var pendingInsert = `INSERT INTO txn_pending (timestamp) VALUES (?);`
+
+var pendingDelete = `DELETE FROM txn_pending WHERE timestamp = ?;`
+
+// Returns the next transaction timestamp and records it as pending. The
+// timestamp is taken in a transaction of its own, so the clock is not locked
+// for the duration of the batch
+func (mbd *mysqlBackend) nextTimestamp(ctx context.Context) (time.Time, error) {
+	tx, err := mbd.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ZERO_TIME, err
+	}
+	res, err := tx.ExecContext(ctx, clockTick)
+	if err != nil {
+		tx.Rollback()
+		return ZERO_TIME, err
+	}
+	micros, err := res.LastInsertId()
+	if err == nil {
+		_, err = tx.ExecContext(ctx, pendingInsert, micros)
+	}
+	if err != nil {
+		tx.Rollback()
+		return ZERO_TIME, err
+	}
+	if err = tx.Commit(); err != nil {
+		return ZERO_TIME, err
+	}
+	return clockTime(micros), nil
+}
+
+// Returns the value of the clock for a transaction timestamp, in microseconds
+func clockValue(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+func clockTime(micros int64) time.Time {
+	return time.Unix(0, micros*int64(time.Microsecond)).UTC()
+}
+
+// the number of times a batch is attempted before ErrConflict is returned
+const maxCommitAttempts = 5
+
+// Returned when a batch kept conflicting with concurrent batches that edited
+// the same documents
+var ErrConflict = errors.New("Batch conflicted with concurrent edits to the same documents")
+
+// Returns whether a failed transaction can be retried: it lost to a
+// concurrent batch, or MySQL rolled it back to resolve a deadlock or a lock
+// wait timeout
+func retryable(err error) bool {
+	if err == ErrConflict {
+		return true
+	}
+	if merr, ok := err.(*mysql.MySQLError); ok {
+		return merr.Number == 1213 || merr.Number == 1205
+	}
+	return false
+}
+
+// Runs f in a transaction that edits the given documents, with the
+// transaction timestamp of the attempt, and commits it if no other batch
+// committed edits to the documents in the meantime. The first attempt does
+// not lock the documents until it commits. A conflicting attempt is retried
+// with the documents locked before it takes its timestamp: no other batch can
+// then commit edits to them, and every batch that did took an earlier
+// timestamp, so the retry cannot conflict. Only deadlocks and lock wait
+// timeouts make it fail again. Returns the transaction timestamp of the
+// attempt that committed
+func (mbd *mysqlBackend) writeTx(ctx context.Context, uids []uuid.UUID, f func(tx *sql.Tx, timestamp time.Time) error) (time.Time, error) {
+	// versions are locked by row, so every document needs one to lock
+	if err := initVersions(ctx, mbd.db, uids); err != nil {
+		return ZERO_TIME, err
+	}
+	for attempt := 1; ; attempt++ {
+		timestamp, err := mbd.writeAttempt(ctx, uids, f, attempt > 1)
+		if err == nil || !retryable(err) {
+			return timestamp, err
+		}
+		if attempt == maxCommitAttempts {
+			return ZERO_TIME, ErrConflict
+		}
+	}
+}
+
+func (mbd *mysqlBackend) writeAttempt(ctx context.Context, uids []uuid.UUID, f func(tx *sql.Tx, timestamp time.Time) error, lock bool) (time.Time, error) {
+	tx, err := mbd.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ZERO_TIME, err
+	}
+	// a locking read sees the latest versions and keeps them until the
+	// transaction ends. Otherwise the first read creates the transaction's
+	// read view, so the versions are those of the state the batch reads
+	var versions map[uuid.UUID]int64
+	if lock {
+		if versions, err = documentVersions(ctx, tx, uids, " for update"); err != nil {
+			tx.Rollback()
+			return ZERO_TIME, err
+		}
+	}
+	timestamp, err := mbd.nextTimestamp(ctx)
+	if err != nil {
+		tx.Rollback()
+		return ZERO_TIME, err
+	}
+	if !lock {
+		versions, err = documentVersions(ctx, tx, uids, "")
+	}
+	if err == nil {
+		err = f(tx, timestamp)
+	}
+	if err == nil {
+		err = claimVersions(ctx, tx, versions, timestamp)
+	}
+	// the timestamp stops being pending when the batch's edits become visible
+	if err == nil {
+		_, err = tx.ExecContext(ctx, pendingDelete, clockValue(timestamp))
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		// ctx may be done, and a timestamp left pending would hold back the
+		// version of every later snapshot
+		mbd.db.ExecContext(context.Background(), pendingDelete, clockValue(timestamp))
+		return ZERO_TIME, err
+	}
+	return timestamp, nil
+}
+
+var initVersionsTemplate = `INSERT IGNORE INTO document_versions (uuid, version) VALUES %s;`
+
+// Creates the versions of the documents that no batch has edited yet
+func initVersions(ctx context.Context, db queryer, uids []uuid.UUID) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(uids))
+	for idx, uid := range uids {
+		args[idx] = uid.String()
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf(initVersionsTemplate, placeholders(len(uids), "(?, 0)")), args...)
+	return err
+}
+
+var documentVersionsTemplate = `
+select uuid, version from document_versions
+where uuid in (%s)
+order by uuid%s;
+`
+
+// Returns the version of each of the documents: the transaction timestamp,
+// in microseconds, of the last batch that edited it, or 0. lock is appended
+// to the select
+func documentVersions(ctx context.Context, tx *sql.Tx, uids []uuid.UUID, lock string) (map[uuid.UUID]int64, error) {
+	versions := make(map[uuid.UUID]int64, len(uids))
+	if len(uids) == 0 {
+		return versions, nil
+	}
+	args := make([]interface{}, len(uids))
+	for idx, uid := range uids {
+		args[idx] = uid.String()
+		versions[uid] = 0
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(documentVersionsTemplate, placeholders(len(uids), "?"), lock), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			uid     string
+			version int64
+		)
+		if err = rows.Scan(&uid, &version); err != nil {
+			return nil, err
+		}
+		parsed, err := uuid.FromString(uid)
+		if err != nil {
+			return nil, err
+		}
+		versions[parsed] = version
+	}
+	return versions, rows.Err()
+}
+
+var claimVersionTemplate = `UPDATE document_versions SET version = ? WHERE uuid = ?;`
+
+// Locks the versions of the documents, checks that they are still the ones
+// the transaction started from and older than its timestamp, and sets them to
+// the timestamp. Returns ErrConflict if another batch committed edits to one
+// of the documents in the meantime, or committed a later timestamp first
+func claimVersions(ctx context.Context, tx *sql.Tx, read map[uuid.UUID]int64, timestamp time.Time) error {
+	uids := make([]uuid.UUID, 0, len(read))
+	for uid := range read {
+		uids = append(uids, uid)
+	}
+	latest, err := documentVersions(ctx, tx, uids, " for update")
+	if err != nil {
+		return err
+	}
+	version := clockValue(timestamp)
+	for _, uid := range uids {
+		if latest[uid] != read[uid] || latest[uid] >= version {
+			return ErrConflict
+		}
+		if _, err = tx.ExecContext(ctx, claimVersionTemplate, version, uid.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Truncates t to the microsecond precision of the timestamp columns. MySQL
+// rounds extra digits, so times are truncated before they are written or
+// compared, which keeps an edit and a query at the same nanosecond time on
+// the same side of each other
+func storedTime(t time.Time) time.Time {
+	return t.Truncate(time.Microsecond)
+}
+
+// Two committed edits set the same key of the same document at the same
+// valid time to different values. The edit of the later transaction is kept
+type Conflict struct {
+	UUID string    `json:"uuid"`
+	Key  string    `json:"key"`
+	Time time.Time `json:"time"`
+	// the value that was replaced and the value that was kept; empty if the
+	// key was removed
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s %s at %s: %q replaced by %q", c.UUID, c.Key, c.Time.Format(time.RFC3339Nano), c.Old, c.New)
+}
+
+var existingEditsTemplate = `
+select dkey, dval from data
+where uuid = ? and timestamp = ? and dkey in (%s);
+`
+
+var deleteEditsTemplate = `
+delete from data
+where uuid = ? and timestamp = ? and dkey in (%s);
+`
+
+// Removes the rows of data that the document's edit at the given time
+// replaces, so that each key of a document has at most one row per valid
+// time. Returns the replaced rows whose values differ from the edit
+func replaceEdits(ctx context.Context, db queryer, doc *Document, timestamp time.Time) ([]Conflict, error) {
+	var (
+		conflicts    []Conflict
+		args         = []interface{}{doc.UUID.String(), timestamp}
+		placeholders = make([]string, 0, len(doc.Tags))
+	)
+	for key := range doc.Tags {
+		args = append(args, key)
+		placeholders = append(placeholders, "?")
+	}
+	inList := strings.Join(placeholders, ", ")
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(existingEditsTemplate, inList), args...)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for rows.Next() {
+		var (
+			dkey string
+			dval sql.NullString
+		)
+		if err = rows.Scan(&dkey, &dval); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		found = true
+		if dval.String != doc.Tags[dkey] {
+			conflicts = append(conflicts, Conflict{UUID: doc.UUID.String(), Key: dkey, Time: timestamp, Old: dval.String, New: doc.Tags[dkey]})
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || !found {
+		return nil, err
+	}
+	_, err = db.ExecContext(ctx, fmt.Sprintf(deleteEditsTemplate, inList), args...)
+	return conflicts, err
+}
+
+// A read-only transaction over a consistent snapshot of the database
+type Snapshot struct {
+	tx *sql.Tx
+	// every batch with a transaction timestamp up to Version is visible in the
+	// snapshot; batches with later timestamps may be too. Zero if no batch
+	// has committed
+	Version time.Time
+}
+
+// the latest timestamp before which no timestamp is pending, as seen by the
+// read view of the transaction. Timestamps taken after the read view was
+// created are later than the clock it sees, so they cannot be earlier
+var snapshotVersion = `
+select least(clock.last, coalesce((select min(timestamp) - 1 from txn_pending), clock.last))
+from txn_clock as clock
+where clock.id = 1;
+`
+
+// Opens a snapshot of the database as of the moment it is opened. Reads
+// through the snapshot do not block writers or see their later commits. The
+// version is read from the shared clock within the snapshot, so it holds for
+// batches committed by any server. The snapshot must be closed
+func (mbd *mysqlBackend) Snapshot(ctx context.Context) (*Snapshot, error) {
+	tx, err := mbd.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	// InnoDB creates the read view of a transaction at its first read, so the
+	// version is read as of the snapshot
+	var micros int64
+	if err = tx.QueryRowContext(ctx, snapshotVersion).Scan(&micros); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	snapshot := &Snapshot{tx: tx}
+	if micros > 0 {
+		snapshot.Version = clockTime(micros)
+	}
+	return snapshot, nil
+}
+
+// Releases the snapshot
+func (s *Snapshot) Close() error {
+	return s.tx.Rollback()
+}
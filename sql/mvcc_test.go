@@ -0,0 +1,369 @@
+package main
+
+import (
+	query "./lang"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/satori/go.uuid"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		retryable bool
+	}{
+		{ErrConflict, true},
+		// deadlock and lock wait timeout
+		{&mysql.MySQLError{Number: 1213}, true},
+		{&mysql.MySQLError{Number: 1205}, true},
+		// duplicate entry
+		{&mysql.MySQLError{Number: 1062}, false},
+		{errors.New("connection refused"), false},
+	} {
+		if got := retryable(test.err); got != test.retryable {
+			t.Errorf("retryable(%v) = %v but wanted %v", test.err, got, test.retryable)
+		}
+	}
+}
+
+func TestSnapshotVersion(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	// two backends stand for two servers writing to the same database
+	writer, reader := newBackend(user, pass, dbname), newBackend(user, pass, dbname)
+	ctx := context.Background()
+	var uids []uuid.UUID
+	for _, s := range []string{"5a1b2c3d-8cbd-11e5-8bb3-0cc47a0f7eea", "5e6f7a8b-8cbd-11e5-8bb3-0cc47a0f7eea"} {
+		uid, _ := uuid.FromString(s)
+		uids = append(uids, uid)
+		defer removeDocument(writer, uid)
+	}
+	// commits the edit in a batch of its own once release is closed, and
+	// sends its transaction timestamp before that
+	edit := func(backend *mysqlBackend, uid uuid.UUID, val string, started chan<- time.Time, release <-chan struct{}) (time.Time, error) {
+		doc := &Document{UUID: uid, Tags: map[string]string{"Test/Step": val}}
+		return backend.writeTx(ctx, []uuid.UUID{uid}, func(tx *sql.Tx, timestamp time.Time) error {
+			started <- timestamp
+			<-release
+			stmt, args := doc.generateInsert("data", query.SQLTime(timestamp), "")
+			_, err := tx.ExecContext(ctx, stmt, args...)
+			return err
+		})
+	}
+	// whether the snapshot sees the edit at the given transaction timestamp
+	sees := func(snapshot *Snapshot, uid uuid.UUID, timestamp time.Time) bool {
+		var count int
+		if err := snapshot.tx.QueryRowContext(ctx, "select count(*) from data where uuid = ? and timestamp = ?;", uid.String(), timestamp).Scan(&count); err != nil {
+			t.Fatalf("Reading the snapshot failed: %v", err)
+		}
+		return count > 0
+	}
+	immediately := make(chan struct{})
+	close(immediately)
+
+	// a batch committed through another server is part of the version
+	first, err := edit(writer, uids[0], "1", make(chan time.Time, 1), immediately)
+	if err != nil {
+		t.Fatalf("Edit failed: %v", err)
+	}
+	snapshot, err := reader.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if snapshot.Version.Before(first) || !sees(snapshot, uids[0], first) {
+		t.Errorf("Expected a snapshot that sees the batch at %v but got version %v", first, snapshot.Version)
+	}
+	snapshot.Close()
+
+	// a batch that has its timestamp but has not committed holds the version
+	// back, even once a later batch on another document commits
+	var (
+		started = make(chan time.Time, 1)
+		release = make(chan struct{})
+		done    = make(chan error, 1)
+	)
+	go func() {
+		_, err := edit(writer, uids[1], "2", started, release)
+		done <- err
+	}()
+	pending := <-started
+	later, err := edit(reader, uids[0], "3", make(chan time.Time, 1), immediately)
+	if err != nil {
+		t.Fatalf("Edit failed: %v", err)
+	}
+	snapshot, err = reader.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if !snapshot.Version.Before(pending) || snapshot.Version.Before(first) {
+		t.Errorf("Expected a version in [%v, %v) but got %v", first, pending, snapshot.Version)
+	}
+	close(release)
+	if err = <-done; err != nil {
+		t.Fatalf("Edit failed: %v", err)
+	}
+	if sees(snapshot, uids[1], pending) {
+		t.Errorf("Expected the snapshot not to see the batch that committed after it")
+	}
+	snapshot.Close()
+
+	// every batch up to the version is visible
+	snapshot, err = writer.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	defer snapshot.Close()
+	if snapshot.Version.Before(later) || snapshot.Version.Before(pending) {
+		t.Errorf("Expected a version of at least %v and %v but got %v", later, pending, snapshot.Version)
+	}
+	if !sees(snapshot, uids[0], later) || !sees(snapshot, uids[1], pending) {
+		t.Errorf("Expected the snapshot at %v to see both batches", snapshot.Version)
+	}
+}
+
+func TestConflictRetried(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	first, second := newBackend(user, pass, dbname), newBackend(user, pass, dbname)
+	ctx := context.Background()
+	uid, _ := uuid.FromString("5c0d1e2f-8cbd-11e5-8bb3-0cc47a0f7eea")
+	defer removeDocument(first, uid)
+
+	// the first attempt loses to a batch committed through the other server
+	// while it runs, and the retry commits
+	var timestamps []time.Time
+	committed, err := first.writeTx(ctx, []uuid.UUID{uid}, func(tx *sql.Tx, timestamp time.Time) error {
+		timestamps = append(timestamps, timestamp)
+		if len(timestamps) > 1 {
+			return nil
+		}
+		_, err := second.Insert(&Document{UUID: uid, Tags: map[string]string{"Test/Writer": "second"}}, false)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Expected the conflict to be retried but got %v", err)
+	}
+	if len(timestamps) != 2 || committed != timestamps[1] {
+		t.Errorf("Expected a second attempt to commit but got attempts at %v and a commit at %v", timestamps, committed)
+	}
+}
+
+func TestConcurrentInsertAndEval(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	ctx := context.Background()
+	uuidA, _ := uuid.FromString("c1a2b3c4-8cbd-11e5-8bb3-0cc47a0f7eea")
+	uuidB, _ := uuid.FromString("c5a6b7c8-8cbd-11e5-8bb3-0cc47a0f7eea")
+	defer removeDocument(backend, uuidA)
+	defer removeDocument(backend, uuidB)
+	q, err := backend.ParseAll(`select * where has Test/Pair;`)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	var (
+		writers sync.WaitGroup
+		readers sync.WaitGroup
+		stop    = make(chan struct{})
+	)
+	// each batch sets the key on both documents to the same value
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 0; i < 20; i++ {
+				batch, err := backend.Begin(ctx)
+				if err != nil {
+					t.Errorf("Begin failed: %v", err)
+					return
+				}
+				val := fmt.Sprintf("%d-%d", w, i)
+				batch.Insert(&Document{UUID: uuidA, Tags: map[string]string{"Test/Pair": val}}, false)
+				batch.Insert(&Document{UUID: uuidB, Tags: map[string]string{"Test/Pair": val}}, false)
+				if err = batch.Commit(); err != nil {
+					t.Errorf("Commit failed: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	// readers must never see one document of a batch without the other, and
+	// versions must not go backwards
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			var last time.Time
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				results, err := backend.EvalBatch(ctx, q, true)
+				if err != nil {
+					t.Errorf("EvalBatch failed: %v", err)
+					return
+				}
+				if results[0].Version.Before(last) {
+					t.Errorf("Snapshot version went backwards from %v to %v", last, results[0].Version)
+				}
+				last = *results[0].Version
+				docs := results[0].Documents
+				if len(docs) == 2 && docs[0].Tags["Test/Pair"] != docs[1].Tags["Test/Pair"] {
+					t.Errorf("Saw a partial batch: %v and %v", docs[0].Tags, docs[1].Tags)
+				} else if len(docs) == 1 {
+					t.Errorf("Saw a partial batch: %v", docs[0].Tags)
+				}
+			}
+		}()
+	}
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	// two backends stand for two servers writing to the same database
+	backends := []*mysqlBackend{newBackend(user, pass, dbname), newBackend(user, pass, dbname)}
+	ctx := context.Background()
+	shared, _ := uuid.FromString("cabbc0d1-8cbd-11e5-8bb3-0cc47a0f7eea")
+	defer removeDocument(backends[0], shared)
+
+	var (
+		wg    sync.WaitGroup
+		lock  sync.Mutex
+		times = map[time.Time]bool{}
+	)
+	for w := 0; w < 8; w++ {
+		own, _ := uuid.FromString(fmt.Sprintf("cabbc0d1-8cbd-11e5-8bb3-0cc47a0f7e%02d", w))
+		defer removeDocument(backends[0], own)
+		wg.Add(1)
+		go func(w int, own uuid.UUID) {
+			defer wg.Done()
+			backend := backends[w%2]
+			for i := 0; i < 10; i++ {
+				batch, err := backend.Begin(ctx)
+				if err != nil {
+					t.Errorf("Begin failed: %v", err)
+					return
+				}
+				batch.Insert(&Document{UUID: own, Tags: map[string]string{"Test/Writer": fmt.Sprintf("%d", i)}}, false)
+				batch.Insert(&Document{UUID: shared, Tags: map[string]string{fmt.Sprintf("Test/Writer%d", w): fmt.Sprintf("%d", i)}}, false)
+				// a batch that loses to a concurrent one on the shared
+				// document is retried with it locked, which cannot lose
+				// again, so every commit succeeds
+				if err = batch.Commit(); err != nil {
+					t.Errorf("Commit failed: %v", err)
+					return
+				}
+				lock.Lock()
+				times[batch.Timestamp()] = true
+				lock.Unlock()
+			}
+		}(w, own)
+	}
+	wg.Wait()
+
+	// every batch got its own timestamp, including across backends, and no
+	// edit to the shared document was lost
+	if len(times) != 80 {
+		t.Errorf("Expected 80 distinct transaction timestamps but got %d", len(times))
+	}
+	edits, err := backends[0].History(ctx, shared, ZERO_TIME, ZERO_TIME)
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	if len(edits) != 80 {
+		t.Errorf("Expected 80 edits to the shared document but got %d", len(edits))
+	}
+	doc, err := backends[1].CurrentDocument(ctx, shared)
+	if err != nil {
+		t.Fatalf("CurrentDocument failed: %v", err)
+	}
+	for w := 0; w < 8; w++ {
+		if val := doc.Tags[fmt.Sprintf("Test/Writer%d", w)]; val != "9" {
+			t.Errorf("Expected the last edit of writer %d but got %q", w, val)
+		}
+	}
+}
+
+func TestConflictingEdits(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	ctx := context.Background()
+	uid, _ := uuid.FromString("c9aab0c1-8cbd-11e5-8bb3-0cc47a0f7eea")
+	defer removeDocument(backend, uid)
+	validTime := time.Unix(5000, 0)
+
+	// every writer sets the same key at the same valid time
+	var (
+		wg        sync.WaitGroup
+		lock      sync.Mutex
+		latest    time.Time
+		kept      string
+		conflicts int
+	)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			batch, err := backend.Begin(ctx)
+			if err != nil {
+				t.Errorf("Begin failed: %v", err)
+				return
+			}
+			val := fmt.Sprintf("writer %d", w)
+			batch.InsertWithTimestamp(&Document{UUID: uid, Tags: map[string]string{"Test/Conflict": val}}, validTime, false)
+			if err = batch.Commit(); err != nil {
+				t.Errorf("Commit failed: %v", err)
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			conflicts += len(batch.Conflicts())
+			if batch.Timestamp().After(latest) {
+				latest = batch.Timestamp()
+				kept = val
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// the edit of the latest transaction wins, replacing every other one
+	if conflicts != 7 {
+		t.Errorf("Expected 7 conflicts but got %d", conflicts)
+	}
+	var rows int
+	if err := backend.db.QueryRow("SELECT COUNT(*) FROM data WHERE uuid = ?;", uid.String()).Scan(&rows); err != nil {
+		t.Fatalf("Could not count rows: %v", err)
+	}
+	if rows != 1 {
+		t.Errorf("Expected a single row for the key but got %d", rows)
+	}
+	for _, at := range []time.Time{validTime, ZERO_TIME} {
+		doc, err := backend.DocumentAt(ctx, uid, at)
+		if err != nil {
+			t.Fatalf("DocumentAt failed: %v", err)
+		}
+		if doc.Tags["Test/Conflict"] != kept {
+			t.Errorf("DocumentAt %v: expected %q from the latest transaction but got %q", at, kept, doc.Tags["Test/Conflict"])
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	query "./lang"
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A change of a key of a document from one value to a different one. The
+// documents matching a changed(Key) term carry the changes it matched
+type Transition struct {
+	Key  string    `json:"key"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	Time time.Time `json:"time"`
+}
+
+// Returns the changes matched by the query's changed(Key) terms, by document
+// UUID and ordered by time. Only the changes of the documents the query
+// matches are read. They are read before the documents, since db may be a
+// transaction
+func transitions(ctx context.Context, db queryer, q *query.Query) (map[string][]Transition, error) {
+	if len(q.Transitions) == 0 {
+		return nil, nil
+	}
+	found := map[string][]Transition{}
+	for _, term := range q.Transitions {
+		rows, err := db.QueryContext(ctx, term.SQL(matchedCondition("cur.uuid", q)))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var (
+				duuid      string
+				transition Transition
+				from, to   sql.NullString
+			)
+			if err = rows.Scan(&duuid, &transition.Key, &from, &to, &transition.Time); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			transition.From, transition.To = from.String, to.String
+			found[duuid] = append(found[duuid], transition)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for duuid, changes := range found {
+		sort.SliceStable(changes, func(i, j int) bool { return changes[i].Time.Before(changes[j].Time) })
+		// terms on the same key may match the same change
+		unique := changes[:0]
+		for _, change := range changes {
+			if len(unique) == 0 || change != unique[len(unique)-1] {
+				unique = append(unique, change)
+			}
+		}
+		found[duuid] = unique
+	}
+	return found, nil
+}
+
+// Returns a condition restricting the column to the UUIDs of the documents
+// the query's WHERE clause matches, or "" if it has none
+func matchedCondition(column string, q *query.Query) string {
+	if q.Wheres.SQL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s in (select matched.uuid from (%s) as matched)", column, q.Wheres.SQL)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"github.com/satori/go.uuid"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChangedPredicate(t *testing.T) {
+	user := os.Getenv("ARONNAXTESTUSER")
+	pass := os.Getenv("ARONNAXTESTPASS")
+	dbname := os.Getenv("ARONNAXTESTDB")
+	backend := newBackend(user, pass, dbname)
+	ctx := context.Background()
+	var uids []uuid.UUID
+	for _, s := range []string{"f1a2b3c4-8cbd-11e5-8bb3-0cc47a0f7eea", "f5a6b7c8-8cbd-11e5-8bb3-0cc47a0f7eea", "f9aab0c1-8cbd-11e5-8bb3-0cc47a0f7eea", "fdaeb4c5-8cbd-11e5-8bb3-0cc47a0f7eea"} {
+		uid, _ := uuid.FromString(s)
+		uids = append(uids, uid)
+		defer removeDocument(backend, uid)
+	}
+	for _, edit := range []struct {
+		doc  int
+		val  string
+		time int64
+	}{
+		// swapped in the window
+		{0, "SHT11", 100},
+		{0, "SHT13", 250},
+		// swapped before the window
+		{1, "SHT11", 100},
+		{1, "SHT13", 150},
+		{1, "", 220},
+		{1, "SHT13", 230},
+		// swapped the other way
+		{2, "SHT13", 100},
+		{2, "SHT11", 260},
+		// removed, then replaced in the window
+		{3, "SHT11", 100},
+		{3, "", 200},
+		{3, "SHT13", 240},
+	} {
+		doc := &Document{UUID: uids[edit.doc], Tags: map[string]string{"Test/Model": edit.val}}
+		if _, err := backend.InsertWithTimestamp(doc, time.Unix(edit.time, 0), false); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		querystring string
+		matches     []uuid.UUID
+		times       []int64
+	}{
+		{`select * where changed(Test/Model) from "SHT11" to "SHT13" in (200, 300);`, []uuid.UUID{uids[0], uids[3]}, []int64{250, 240}},
+		{`select * where changed(Test/Model) from "SHT11" to "SHT13";`, []uuid.UUID{uids[0], uids[1], uids[3]}, []int64{250, 150, 240}},
+		{`select * where changed(Test/Model) in (200, 300);`, []uuid.UUID{uids[0], uids[2], uids[3]}, []int64{250, 260, 240}},
+		// changes are only read for the documents the rest of the query matches
+		{`select * where changed(Test/Model) and Test/Model = "SHT11";`, uids[2:3], []int64{260}},
+	} {
+		q, err := backend.Parse(test.querystring)
+		if err != nil {
+			t.Fatalf("Parse failed: %v", err)
+		}
+		docs, err := backend.Eval(ctx, q)
+		if err != nil {
+			t.Fatalf("Eval failed: %v", err)
+		}
+		got := map[uuid.UUID]int64{}
+		for _, doc := range docs {
+			if len(doc.Transitions) != 1 {
+				t.Errorf("Query %v: expected one change of %v but got %v", test.querystring, doc.UUID, doc.Transitions)
+				continue
+			}
+			got[doc.UUID] = doc.Transitions[0].Time.Unix()
+		}
+		expected := map[uuid.UUID]int64{}
+		for idx, uid := range test.matches {
+			expected[uid] = test.times[idx]
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Query %v: got changes %v but wanted %v", test.querystring, got, expected)
+		}
+	}
+}